@@ -0,0 +1,95 @@
+package main
+
+// This file contains the generic helpers for providers that only offer a plain REST/JSON api
+// rather than a go sdk, the provider specific bits live in the CLOUDNAME.go files
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+var apiHTTPClient = &http.Client{Timeout: 30 * time.Second}
+
+// apiError is returned when a provider api answers with an error status code
+type apiError struct {
+	provider   string
+	statusCode int
+	body       string
+	// retryAfter is how long the api asked us to wait before trying again, zero when it didn't say
+	retryAfter time.Duration
+}
+
+func (e *apiError) Error() string {
+	return e.provider + " API error " + strconv.Itoa(e.statusCode) + ": " + e.body
+}
+
+// apiRequest sends a json request to a provider api, headers carries the provider specific
+// authentication and the response is decoded into result unless result is nil. url starts with
+// the provider's endpoint, ie hetznerEndpoint, which is a var rather than a const so tests can
+// point it at a mock api
+func apiRequest(ctx context.Context, provider, method, url string, headers map[string]string, body interface{}, result interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		jsonData, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(jsonData)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, method, url, reqBody)
+	if err != nil {
+		return err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	req.Header.Set("Accept", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := apiHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode >= 400 {
+		return &apiError{
+			provider:   provider,
+			statusCode: resp.StatusCode,
+			body:       string(respBody),
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	if result != nil && len(respBody) > 0 {
+		return json.Unmarshal(respBody, result)
+	}
+	return nil
+}
+
+// parseRetryAfter reads a Retry-After header, which is either a number of seconds or a http date
+func parseRetryAfter(header string) time.Duration {
+	if header == "" {
+		return 0
+	}
+	if seconds, err := strconv.Atoi(header); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(header); err == nil && time.Until(date) > 0 {
+		return time.Until(date)
+	}
+	return 0
+}
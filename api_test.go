@@ -0,0 +1,72 @@
+package main
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"sync"
+	"testing"
+)
+
+// apiCall is a request the mock api received
+type apiCall struct {
+	method string
+	path   string
+	query  string
+	header http.Header
+	body   string
+}
+
+// mockAPI is a provider api for tests, every request it receives is recorded in calls
+type mockAPI struct {
+	sync.Mutex
+	calls []apiCall
+}
+
+// startMockAPI points endpoint at a new mock api for the rest of the test, answer writes the
+// response to each request
+func startMockAPI(t *testing.T, endpoint *string, answer func(w http.ResponseWriter, call apiCall)) *mockAPI {
+	t.Helper()
+	mock := &mockAPI{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		call := apiCall{method: r.Method, path: r.URL.EscapedPath(), query: r.URL.RawQuery, header: r.Header, body: string(body)}
+		mock.Lock()
+		mock.calls = append(mock.calls, call)
+		mock.Unlock()
+		answer(w, call)
+	}))
+	saved := *endpoint
+	*endpoint = server.URL
+	t.Cleanup(func() {
+		*endpoint = saved
+		server.Close()
+	})
+	return mock
+}
+
+// requests returns the method and path of every request received, in order
+func (m *mockAPI) requests() []string {
+	m.Lock()
+	defer m.Unlock()
+	var requests []string
+	for _, call := range m.calls {
+		requests = append(requests, call.method+" "+call.path)
+	}
+	return requests
+}
+
+// received returns every request received, in order
+func (m *mockAPI) received() []apiCall {
+	m.Lock()
+	defer m.Unlock()
+	return slices.Clone(m.calls)
+}
+
+// last returns the last request received
+func (m *mockAPI) last() apiCall {
+	m.Lock()
+	defer m.Unlock()
+	return m.calls[len(m.calls)-1]
+}
@@ -1,121 +1,305 @@
 package main
 
 import (
+	"context"
 	"errors"
-	"net/http"
+	"fmt"
+	"net"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/route53"
+	"github.com/miekg/dns"
 )
 
-func awsHandler(w http.ResponseWriter, r *http.Request) {
+const (
+	// route53 is a global service but its api and sts are signed for us-east-1
+	awsDefaultRegion = "us-east-1"
 
-	client := r.Header.Get("X-Forwarded-For")
-	if client == "" {
-		client = r.RemoteAddr
-	}
+	// awsWaitInterval is how often GetChange is polled while waiting for a change to be INSYNC
+	awsWaitInterval = 2 * time.Second
+	// awsWaitTimeout is how long to wait for a change to be INSYNC unless waittimeout says otherwise,
+	// the wait never runs past the request's deadline either so the client still gets an answer
+	awsWaitTimeout = 20 * time.Second
+
+	// hosted zone visibility, which zones awsHostedZone may return
+	awsAnyZone     = ""
+	awsPublicZone  = "public"
+	awsPrivateZone = "private"
+)
+
+// awsCredentialSettings are the settings a route53 client is made from
+var awsCredentialSettings = []string{"accesskey", "secretkey", "sessiontoken", "profile", "rolearn", "externalid", "region"}
+
+// awsZoneUpdate is the addresses written to one hosted zone
+type awsZoneUpdate struct {
+	visibility string
+	zoneid     string
+	ips        []string
+	// cacheKey is where the zone id found for the update is cached
+	cacheKey string
+}
 
-	ip, hostname, err := checkForms(r)
+func awsUpdate(ctx context.Context, settings map[string]string, update *dnsUpdate) error {
+	wait, err := settingBool(settings, "wait")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		logger("client: "+client+" "+err.Error(), "err")
+		return err
 	}
-
-	// gets 3rd entry since url should be hostname/aws/zoneid
-	// makes sure the zoneid is included in the url
-	getZoneid := r.URL.Path
-	// 4th entry should be the ?ip= blah blah
-	// 2nd is the /aws/ so
-	if len(strings.Split(getZoneid, "/")) != 4 {
-		http.Error(w, "zoneid not detected", http.StatusBadRequest)
-		logger("client: "+client+" zoneid not detected", "err")
-		return
-	} else {
-		getZoneid = strings.Split(getZoneid, "/")[2]
+	waitTimeout, err := settingDuration(settings, "waittimeout", awsWaitTimeout)
+	if err != nil {
+		return err
+	}
+	split, err := settingBool(settings, "split")
+	if err != nil {
+		return err
 	}
 
 	// Setup AWS Session
-	awsSession, err := awsSetup(user, pass)
+	r53, err := awsSetup(settings)
+	if err != nil {
+		return err
+	}
 
-	if awsSession != nil {
-		// if session is created then updated dns
-		err = awsRoute53(awsSession, getZoneid, hostname, ip)
+	// with split horizon private addresses go to the private hosted zone of the name and the rest
+	// to the public one, each zone still gets only the first address of each type
+	zones := []*awsZoneUpdate{{visibility: awsAnyZone, zoneid: settings["zoneid"], ips: update.primaryIPs()}}
+	if split || settings["privatezoneid"] != "" {
+		public := &awsZoneUpdate{visibility: awsPublicZone, zoneid: settings["zoneid"]}
+		private := &awsZoneUpdate{visibility: awsPrivateZone, zoneid: settings["privatezoneid"]}
+		for _, ip := range update.ips {
+			if isPrivateIP(ip) {
+				private.ips = append(private.ips, ip)
+			} else {
+				public.ips = append(public.ips, ip)
+			}
+		}
+		zones = nil
+		for _, zone := range []*awsZoneUpdate{public, private} {
+			if len(zone.ips) > 0 {
+				zone.ips = (&dnsUpdate{ips: zone.ips}).primaryIPs()
+				zones = append(zones, zone)
+			}
+		}
 	}
-	if err != nil {
-		logger("client:"+client+" "+err.Error(), "err")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	} else {
-		w.WriteHeader(200)
-		w.Write([]byte("OK\n"))
-		logger("client: "+client+" succesfully updated AWS DNS hostname: "+hostname+" ip: "+ip, "info")
+
+	// every zone is looked up before anything is changed so a missing one doesn't leave half an update
+	for _, zone := range zones {
+		zone.cacheKey = cacheKey("route53-zone", append(settingValues(settings, awsCredentialSettings...), zone.zoneid, zone.visibility, update.hostname)...)
+		zone.zoneid, err = cached(zone.cacheKey, zoneCacheTTL, func() (string, error) {
+			return awsHostedZone(ctx, r53, zone.zoneid, zone.visibility, update.hostname)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	var changes []string
+	for _, zone := range zones {
+		changeID, err := awsRoute53(ctx, r53, zone.zoneid, update.hostname, zone.ips, update.ttl)
+		if err != nil {
+			// the zone may have been deleted since it was cached, look it up again next time
+			if classifyError(err) == errorNotFound {
+				forgetCached(zone.cacheKey)
+			}
+			return err
+		}
+		changes = append(changes, changeID)
+	}
+	if wait {
+		for _, changeID := range changes {
+			err = awsWaitForChange(ctx, r53, changeID, waitTimeout)
+			if err != nil {
+				return err
+			}
+		}
 	}
+	return nil
+}
 
+// isPrivateIP reports whether ip is only reachable from inside a network, these go to the private
+// hosted zone with split horizon
+func isPrivateIP(ip string) bool {
+	parsed := net.ParseIP(ip)
+	return parsed.IsPrivate() || parsed.IsLoopback() || parsed.IsLinkLocalUnicast()
 }
 
-func awsSetup(accessKey, secretKey string) (*session.Session, error) {
-	session, err := session.NewSession(&aws.Config{
-		Region:      aws.String("global"),
-		Credentials: credentials.NewStaticCredentials(accessKey, secretKey, ""),
-	})
-	if err != nil {
-		return nil, err
+// awsSetup returns a route53 client for the credentials in settings, keys passed through basic
+// auth are used as they are, a client or target from the server config may leave them out to use
+// the sdk's default chain instead, environment, shared config profile and then the ecs or ec2
+// role, either can then assume a role in another account, clients are reused across requests
+func awsSetup(settings map[string]string) (*route53.Route53, error) {
+	// pass through always sets accesskey, so an anonymous login can never fall back to the
+	// server's own credentials
+	static := false
+	if _, found := settings["accesskey"]; found || settings["secretkey"] != "" {
+		if settings["accesskey"] == "" || settings["secretkey"] == "" {
+			return nil, newDyndnsError(dyndnsBadAuth, "AWS credentials incomplete - need access key and secret key")
+		}
+		static = true
 	}
-	return session, nil
+	key := cacheKey("aws", append([]string{strconv.FormatBool(static)}, settingValues(settings, awsCredentialSettings...)...)...)
+	return cached(key, clientCacheTTL, func() (*route53.Route53, error) {
+		region := settings["region"]
+		if region == "" {
+			region = awsDefaultRegion
+		}
+		config := aws.Config{
+			Region: aws.String(region),
+			// retries are done by withRetry so they fit in the request deadline
+			MaxRetries: aws.Int(0),
+		}
+		if static {
+			config.Credentials = credentials.NewStaticCredentials(settings["accesskey"], settings["secretkey"], settings["sessiontoken"])
+		}
+		awsSession, err := session.NewSessionWithOptions(session.Options{
+			Config:            config,
+			Profile:           settings["profile"],
+			SharedConfigState: session.SharedConfigEnable,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		if settings["rolearn"] == "" {
+			return route53.New(awsSession), nil
+		}
+		roleCredentials := stscreds.NewCredentials(awsSession, settings["rolearn"], func(role *stscreds.AssumeRoleProvider) {
+			role.RoleSessionName = "cloud-ddns"
+			if settings["externalid"] != "" {
+				role.ExternalID = aws.String(settings["externalid"])
+			}
+		})
+		return route53.New(awsSession, &aws.Config{Credentials: roleCredentials}), nil
+	})
 }
 
-func awsRoute53(session *session.Session, zoneid string, hostname string, ip string) error {
-	r53 := route53.New(session)
-	// query list of zones
-	zones, err := r53.ListHostedZones(nil)
-	if err != nil {
-		return err
-	}
-	// ensure zoneid is exists
-	var foundZone bool
-	for z := range zones.HostedZones {
-		foundZone = false
-		if strings.Contains(*zones.HostedZones[z].Id, zoneid) {
-			if strings.Contains(hostname+".", *zones.HostedZones[z].Name) {
-				// fmt.Println("Hostname matches zone")
-				foundZone = true
-				break
-			} else {
-				return errors.New("hostname does not match zone")
+// awsHostedZone returns the id of the hosted zone hostname is updated in, a given zone id has to
+// contain hostname, without one the hosted zone with the longest name containing it is used,
+// visibility limits it to public or private zones
+func awsHostedZone(ctx context.Context, r53 *route53.Route53, zoneid, visibility, hostname string) (string, error) {
+	if zoneid != "" {
+		zone, err := r53.GetHostedZoneWithContext(ctx, &route53.GetHostedZoneInput{Id: aws.String(zoneid)})
+		if err != nil {
+			var awsErr awserr.Error
+			if errors.As(err, &awsErr) && (awsErr.Code() == route53.ErrCodeNoSuchHostedZone || awsErr.Code() == route53.ErrCodeInvalidInput) {
+				return "", newDyndnsError(dyndnsNoHost, "zone not found")
 			}
+			return "", err
+		}
+		if !dns.IsSubDomain(dns.Fqdn(*zone.HostedZone.Name), dns.Fqdn(hostname)) {
+			return "", newDyndnsError(dyndnsNoHost, "hostname does not match zone")
+		}
+		if !awsZoneVisible(zone.HostedZone, visibility) {
+			return "", newDyndnsError(dyndnsNoHost, "zone "+zoneid+" is not a "+visibility+" hosted zone")
+		}
+		return strings.TrimPrefix(*zone.HostedZone.Id, "/hostedzone/"), nil
+	}
 
+	// no zone id, so look through every hosted zone a page at a time, zones that both contain the
+	// hostname and are the same length have the same name
+	var found []*route53.HostedZone
+	err := r53.ListHostedZonesPagesWithContext(ctx, &route53.ListHostedZonesInput{}, func(page *route53.ListHostedZonesOutput, lastPage bool) bool {
+		for _, zone := range page.HostedZones {
+			if !dns.IsSubDomain(dns.Fqdn(*zone.Name), dns.Fqdn(hostname)) || !awsZoneVisible(zone, visibility) {
+				continue
+			}
+			if len(found) == 0 || len(*zone.Name) > len(*found[0].Name) {
+				found = []*route53.HostedZone{zone}
+			} else if len(*zone.Name) == len(*found[0].Name) {
+				found = append(found, zone)
+			}
 		}
+		return true
+	})
+	if err != nil {
+		return "", err
 	}
-	if !foundZone {
-		return errors.New("zone not found")
+	if len(found) == 0 {
+		return "", newDyndnsError(dyndnsNoHost, "no hosted zone matches hostname")
 	}
-	// time for the ugly aws route53 update
+	if len(found) > 1 {
+		return "", newDyndnsError(dyndnsNoHost, "more than one hosted zone named "+*found[0].Name+", give the zone id")
+	}
+	return strings.TrimPrefix(*found[0].Id, "/hostedzone/"), nil
+}
 
-	_, err = r53.ChangeResourceRecordSets(&route53.ChangeResourceRecordSetsInput{
-		ChangeBatch: &route53.ChangeBatch{
-			Changes: []*route53.Change{
-				{
-					Action: aws.String("UPSERT"),
-					ResourceRecordSet: &route53.ResourceRecordSet{
-						Name: aws.String(hostname),
-						Type: aws.String("A"),
-						TTL:  aws.Int64(300),
-						ResourceRecords: []*route53.ResourceRecord{
-							{
-								Value: aws.String(ip),
-							},
-						},
+// awsZoneVisible reports whether zone is the public or private zone asked for
+func awsZoneVisible(zone *route53.HostedZone, visibility string) bool {
+	private := zone.Config != nil && aws.BoolValue(zone.Config.PrivateZone)
+	switch visibility {
+	case awsPublicZone:
+		return !private
+	case awsPrivateZone:
+		return private
+	}
+	return true
+}
+
+// awsRoute53 upserts the records for ips in one change batch and returns the id of the change
+func awsRoute53(ctx context.Context, r53 *route53.Route53, zoneid string, hostname string, ips []string, ttl int) (string, error) {
+	// time for the ugly aws route53 update
+	var changes []*route53.Change
+	for _, ip := range ips {
+		changes = append(changes, &route53.Change{
+			Action: aws.String("UPSERT"),
+			ResourceRecordSet: &route53.ResourceRecordSet{
+				Name: aws.String(hostname),
+				Type: aws.String(recordType(ip)),
+				TTL:  aws.Int64(int64(ttl)),
+				ResourceRecords: []*route53.ResourceRecord{
+					{
+						Value: aws.String(ip),
 					},
 				},
 			},
-		},
+		})
+	}
+	output, err := r53.ChangeResourceRecordSetsWithContext(ctx, &route53.ChangeResourceRecordSetsInput{
+		ChangeBatch:  &route53.ChangeBatch{Changes: changes},
 		HostedZoneId: aws.String(zoneid),
 	})
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	return nil
+	return aws.StringValue(output.ChangeInfo.Id), nil
+}
+
+// awsWaitForChange polls the change until route53 reports it INSYNC on every name server, for at
+// most timeout and never past the request's deadline. A change still pending when it stops has been
+// accepted and will most likely get there, so it's errPending which is answered as good with a note,
+// failing it would have it applied again by retries, failover and the queue and count against the
+// target's health
+func awsWaitForChange(ctx context.Context, r53 *route53.Route53, changeID string, timeout time.Duration) error {
+	start := time.Now()
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	status := route53.ChangeStatusPending
+	pending := func() error {
+		logger("route53 change "+changeID+" accepted but still "+status+" after "+time.Since(start).Round(time.Second).String(), "notice")
+		return errPending
+	}
+	for {
+		output, err := r53.GetChangeWithContext(ctx, &route53.GetChangeInput{Id: aws.String(changeID)})
+		if err != nil {
+			if ctx.Err() != nil {
+				return pending()
+			}
+			return fmt.Errorf("failed to get change status: %w", err)
+		}
+		status = aws.StringValue(output.ChangeInfo.Status)
+		if status == route53.ChangeStatusInsync {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return pending()
+		case <-time.After(awsWaitInterval):
+		}
+	}
 }
@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/route53"
+)
+
+// mockRoute53 returns a route53 client whose GetChange always answers with status
+func mockRoute53(t *testing.T, status string) *route53.Route53 {
+	t.Helper()
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?>
+<GetChangeResponse xmlns="https://route53.amazonaws.com/doc/2013-04-01/">
+  <ChangeInfo><Id>/change/C1</Id><Status>%s</Status><SubmittedAt>2024-01-01T00:00:00Z</SubmittedAt></ChangeInfo>
+</GetChangeResponse>`, status)
+	}))
+	t.Cleanup(server.Close)
+	sess := session.Must(session.NewSession(&aws.Config{
+		Endpoint:    aws.String(server.URL),
+		Region:      aws.String(awsDefaultRegion),
+		Credentials: credentials.NewStaticCredentials("AKIA", "secret", ""),
+	}))
+	return route53.New(sess)
+}
+
+func TestAWSWaitForChange(t *testing.T) {
+	tests := []struct {
+		name        string
+		status      string
+		deadline    time.Duration
+		waitTimeout time.Duration
+		wantErr     error
+		wantBody    string
+	}{
+		{"insync", route53.ChangeStatusInsync, time.Minute, time.Minute, nil, "good 192.0.2.1\n"},
+		{"still pending at the wait timeout", route53.ChangeStatusPending, time.Minute, 200 * time.Millisecond,
+			errPending, "good 192.0.2.1 change accepted but not yet in sync\n"},
+		{"still pending at the request deadline", route53.ChangeStatusPending, 200 * time.Millisecond, time.Minute,
+			errPending, "good 192.0.2.1 change accepted but not yet in sync\n"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r53 := mockRoute53(t, test.status)
+			ctx, cancel := context.WithTimeout(context.Background(), test.deadline)
+			defer cancel()
+			start := time.Now()
+			err := awsWaitForChange(ctx, r53, "/change/C1", test.waitTimeout)
+			if err != test.wantErr {
+				t.Fatalf("err = %v, want %v", err, test.wantErr)
+			}
+			if elapsed := time.Since(start); elapsed > 2*time.Second {
+				t.Errorf("waited %v, past the deadline", elapsed)
+			}
+			// a pending change isn't worth retrying or failing over from
+			if !applied(err) || isTransient(err) {
+				t.Error("pending change treated as a failure")
+			}
+			w := httptest.NewRecorder()
+			respond(w, []string{"192.0.2.1"}, err)
+			if w.Code != http.StatusOK || w.Body.String() != test.wantBody {
+				t.Errorf("response = %d %q, want 200 %q", w.Code, w.Body.String(), test.wantBody)
+			}
+		})
+	}
+}
+
+func TestSettingDuration(t *testing.T) {
+	tests := []struct {
+		value   string
+		want    time.Duration
+		wantErr bool
+	}{
+		{"", awsWaitTimeout, false},
+		{"2m", 2 * time.Minute, false},
+		{"soon", 0, true},
+		{"-5s", 0, true},
+	}
+	for _, test := range tests {
+		got, err := settingDuration(map[string]string{"waittimeout": test.value}, "waittimeout", awsWaitTimeout)
+		if (err != nil) != test.wantErr || got != test.want {
+			t.Errorf("settingDuration(%q) = %v, %v, want %v, error %v", test.value, got, err, test.want, test.wantErr)
+		}
+	}
+}
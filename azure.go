@@ -3,115 +3,175 @@ package main
 import (
 	"context"
 	"errors"
-	"net/http"
+	"fmt"
+	"net"
+	"os"
 	"strings"
 
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/arm"
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/policy"
 	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
 	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
 	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/dns/armdns"
 )
 
-func azureHandler(w http.ResponseWriter, r *http.Request) {
-
-	client := r.Header.Get("X-Forwarded-For")
-	if client == "" {
-		client = r.RemoteAddr
-	}
-
-	ip, hostname, err := checkForms(r)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		logger("client: "+client+" "+err.Error(), "err")
-		return
-	}
-
-	// gets path components since url should be hostname/azure/tenantid/subscriptionid/resource-group/zone-name
-	// makes sure the tenantid, subscriptionid, resource group, and zone name are included in the url
-	pathComponents := strings.Split(r.URL.Path, "/")
-	// Expected: ["", "azure", "tenantid", "subscriptionid", "resource-group", "zone-name", ""]
-	if len(pathComponents) != 7 {
-		http.Error(w, "invalid path format - expected /azure/tenantid/subscriptionid/resource-group/zone-name/", http.StatusBadRequest)
-		logger("client: "+client+" invalid path format", "err")
-		return
-	}
-
-	getTenantId := pathComponents[2]
-	getSubscriptionId := pathComponents[3]
-	getResourceGroup := pathComponents[4]
-	getZoneName := pathComponents[5]
+// azure credential types, picked with the "credential" setting, a login passed through basic auth
+// is always a client secret
+const (
+	azureSecretCredential           = "secret"
+	azureCertificateCredential      = "certificate"
+	azureManagedIdentityCredential  = "managedidentity"
+	azureWorkloadIdentityCredential = "workloadidentity"
+	azureDefaultCredential          = "default"
+)
 
-	if getTenantId == "" || getSubscriptionId == "" || getResourceGroup == "" || getZoneName == "" {
-		http.Error(w, "tenantid, subscriptionid, resource-group, and zone-name are required", http.StatusBadRequest)
-		logger("client: "+client+" missing required path components", "err")
-		return
-	}
+// retries are done by withRetry so they fit in the request deadline
+var azureClientOptions = &arm.ClientOptions{ClientOptions: policy.ClientOptions{Retry: policy.RetryOptions{MaxRetries: -1}}}
 
+func azureUpdate(ctx context.Context, settings map[string]string, update *dnsUpdate) error {
 	// Setup Azure DNS Client
-	azureClient, err := azureSetup(user, pass, getTenantId, getSubscriptionId)
-
-	if azureClient != nil {
-		// if client is created then update dns
-		err = azureDNS(azureClient, getResourceGroup, getZoneName, hostname, ip)
-	}
+	azureClient, err := azureSetup(settings)
 	if err != nil {
-		logger("client:"+client+" "+err.Error(), "err")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	} else {
-		w.WriteHeader(200)
-		w.Write([]byte("OK\n"))
-		logger("client: "+client+" succesfully updated Azure DNS hostname: "+hostname+" ip: "+ip, "info")
+		return err
 	}
-
-}
-
-func azureSetup(clientId, clientSecret, tenantId, subscriptionId string) (*armdns.RecordSetsClient, error) {
-	cred, err := azidentity.NewClientSecretCredential(tenantId, clientId, clientSecret, nil)
+	recordName, err := azureRecordName(update.hostname, settings["zone"])
 	if err != nil {
-		return nil, errors.New("failed to create azure credentials")
+		return err
 	}
-
-	client, err := armdns.NewRecordSetsClient(subscriptionId, cred, nil)
-	if err != nil {
-		return nil, errors.New("failed to create azure dns client")
+	// if client is created then update dns
+	for _, ip := range update.primaryIPs() {
+		err = azureDNS(ctx, azureClient, settings["resourcegroup"], settings["zone"], recordName, ip, update.ttl)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	return client, nil
+// azureCredentialSettings are the settings an azure client is made from
+var azureCredentialSettings = []string{"credential", "tenantid", "clientid", "clientsecret", "certificate", "certificatepassword", "tokenfile", "subscriptionid"}
+
+// azureSetup returns a client for the zone's subscription, clients are reused across requests so
+// the credential's token is too
+func azureSetup(settings map[string]string) (*armdns.RecordSetsClient, error) {
+	return cached(cacheKey("azure", settingValues(settings, azureCredentialSettings...)...), clientCacheTTL, func() (*armdns.RecordSetsClient, error) {
+		cred, err := azureCredential(settings)
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := armdns.NewRecordSetsClient(settings["subscriptionid"], cred, azureClientOptions)
+		if err != nil {
+			return nil, errors.New("failed to create azure dns client")
+		}
+
+		return client, nil
+	})
 }
 
-func azureDNS(client *armdns.RecordSetsClient, resourceGroupName string, zoneName string, hostname string, ip string) error {
-	ctx := context.Background()
+// azureCredential returns the credential chosen by the "credential" setting, a client secret by
+// default, the managed, workload and default credentials pick up what azure provides to the host
+// so only the server config can ask for them
+func azureCredential(settings map[string]string) (azcore.TokenCredential, error) {
+	tenantId, clientId := settings["tenantid"], settings["clientid"]
+	switch settings["credential"] {
+	case "", azureSecretCredential:
+		if tenantId == "" || clientId == "" || settings["clientsecret"] == "" {
+			return nil, newDyndnsError(dyndnsBadAuth, "Azure credentials incomplete - need tenant id, client id and client secret")
+		}
+		cred, err := azidentity.NewClientSecretCredential(tenantId, clientId, settings["clientsecret"], nil)
+		if err != nil {
+			return nil, errors.New("failed to create azure credentials")
+		}
+		return cred, nil
+	case azureCertificateCredential:
+		certData, err := os.ReadFile(settings["certificate"])
+		if err != nil {
+			return nil, errors.New("failed to read azure certificate: " + err.Error())
+		}
+		certs, key, err := azidentity.ParseCertificates(certData, []byte(settings["certificatepassword"]))
+		if err != nil {
+			return nil, errors.New("failed to parse azure certificate: " + err.Error())
+		}
+		cred, err := azidentity.NewClientCertificateCredential(tenantId, clientId, certs, key, nil)
+		if err != nil {
+			return nil, errors.New("failed to create azure credentials: " + err.Error())
+		}
+		return cred, nil
+	case azureManagedIdentityCredential:
+		// a client id picks a user assigned identity, without one the system assigned identity is used
+		options := &azidentity.ManagedIdentityCredentialOptions{}
+		if clientId != "" {
+			options.ID = azidentity.ClientID(clientId)
+		}
+		cred, err := azidentity.NewManagedIdentityCredential(options)
+		if err != nil {
+			return nil, errors.New("failed to create azure credentials: " + err.Error())
+		}
+		return cred, nil
+	case azureWorkloadIdentityCredential:
+		// anything left out is read from the AZURE_* variables the workload identity webhook sets
+		cred, err := azidentity.NewWorkloadIdentityCredential(&azidentity.WorkloadIdentityCredentialOptions{
+			ClientID:      clientId,
+			TenantID:      tenantId,
+			TokenFilePath: settings["tokenfile"],
+		})
+		if err != nil {
+			return nil, errors.New("failed to create azure credentials: " + err.Error())
+		}
+		return cred, nil
+	case azureDefaultCredential:
+		cred, err := azidentity.NewDefaultAzureCredential(&azidentity.DefaultAzureCredentialOptions{TenantID: tenantId})
+		if err != nil {
+			return nil, errors.New("failed to create azure credentials: " + err.Error())
+		}
+		return cred, nil
+	}
+	return nil, newDyndnsError(dyndnsBadAgent, "unknown azure credential "+settings["credential"])
+}
 
+// azureRecordName returns the name of hostname's record set inside zoneName, the public and
+// private dns apis name them the same way
+func azureRecordName(hostname, zoneName string) (string, error) {
 	// Extract record name from hostname and zone name
 	// For example: host.example.com with zone example.com -> host
 	// If hostname equals zone name, it's the root record (@)
-	var recordName string
 	if hostname == zoneName {
-		recordName = "@"
+		return "@", nil
 	} else if strings.HasSuffix(hostname, "."+zoneName) {
-		recordName = strings.TrimSuffix(hostname, "."+zoneName)
-	} else {
-		return errors.New("hostname " + hostname + " does not belong to zone " + zoneName)
-	}
-
-	// Create the A record data
-	aRecords := []*armdns.ARecord{
-		{
-			IPv4Address: to.Ptr(ip),
-		},
+		return strings.TrimSuffix(hostname, "."+zoneName), nil
 	}
+	return "", newDyndnsError(dyndnsNoHost, "hostname "+hostname+" does not belong to zone "+zoneName)
+}
 
+func azureDNS(ctx context.Context, client *armdns.RecordSetsClient, resourceGroupName string, zoneName string, recordName string, ip string, ttl int) error {
+	// Create the A or AAAA record data
 	recordSetParams := armdns.RecordSet{
 		Properties: &armdns.RecordSetProperties{
-			TTL:      to.Ptr[int64](300),
-			ARecords: aRecords,
+			TTL: to.Ptr(int64(ttl)),
 		},
 	}
+	rrType := armdns.RecordTypeA
+	if net.ParseIP(ip).To4() != nil {
+		recordSetParams.Properties.ARecords = []*armdns.ARecord{
+			{
+				IPv4Address: to.Ptr(ip),
+			},
+		}
+	} else {
+		rrType = armdns.RecordTypeAAAA
+		recordSetParams.Properties.AaaaRecords = []*armdns.AaaaRecord{
+			{
+				IPv6Address: to.Ptr(ip),
+			},
+		}
+	}
 
 	// Try to create or update the record (UPSERT operation)
-	_, err := client.CreateOrUpdate(ctx, resourceGroupName, zoneName, recordName, armdns.RecordTypeA, recordSetParams, nil)
+	_, err := client.CreateOrUpdate(ctx, resourceGroupName, zoneName, recordName, rrType, recordSetParams, nil)
 	if err != nil {
-		return errors.New("failed to create/update dns record: " + err.Error())
+		return fmt.Errorf("failed to create/update dns record: %w", err)
 	}
 
 	return nil
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore/to"
+	"github.com/Azure/azure-sdk-for-go/sdk/resourcemanager/privatedns/armprivatedns"
+)
+
+func azurePrivateUpdate(ctx context.Context, settings map[string]string, update *dnsUpdate) error {
+	// Azure Private DNS takes the same settings and credentials as public Azure DNS
+	azureClient, err := azurePrivateSetup(settings)
+	if err != nil {
+		return err
+	}
+	recordName, err := azureRecordName(update.hostname, settings["zone"])
+	if err != nil {
+		return err
+	}
+	for _, ip := range update.primaryIPs() {
+		err = azurePrivateDNS(ctx, azureClient, settings["resourcegroup"], settings["zone"], recordName, ip, update.ttl)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func azurePrivateSetup(settings map[string]string) (*armprivatedns.RecordSetsClient, error) {
+	return cached(cacheKey("azureprivate", settingValues(settings, azureCredentialSettings...)...), clientCacheTTL, func() (*armprivatedns.RecordSetsClient, error) {
+		cred, err := azureCredential(settings)
+		if err != nil {
+			return nil, err
+		}
+
+		client, err := armprivatedns.NewRecordSetsClient(settings["subscriptionid"], cred, azureClientOptions)
+		if err != nil {
+			return nil, errors.New("failed to create azure private dns client")
+		}
+
+		return client, nil
+	})
+}
+
+func azurePrivateDNS(ctx context.Context, client *armprivatedns.RecordSetsClient, resourceGroupName string, zoneName string, recordName string, ip string, ttl int) error {
+	// Create the A or AAAA record data
+	recordSetParams := armprivatedns.RecordSet{
+		Properties: &armprivatedns.RecordSetProperties{
+			TTL: to.Ptr(int64(ttl)),
+		},
+	}
+	rrType := armprivatedns.RecordTypeA
+	if net.ParseIP(ip).To4() != nil {
+		recordSetParams.Properties.ARecords = []*armprivatedns.ARecord{
+			{
+				IPv4Address: to.Ptr(ip),
+			},
+		}
+	} else {
+		rrType = armprivatedns.RecordTypeAAAA
+		recordSetParams.Properties.AaaaRecords = []*armprivatedns.AaaaRecord{
+			{
+				IPv6Address: to.Ptr(ip),
+			},
+		}
+	}
+
+	// the private dns api takes the record type before the name, unlike the public one
+	_, err := client.CreateOrUpdate(ctx, resourceGroupName, zoneName, rrType, recordName, recordSetParams, nil)
+	if err != nil {
+		return fmt.Errorf("failed to create/update private dns record: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,98 @@
+package main
+
+// This file caches what's expensive to set up for every request, authenticated provider clients
+// and the zone ids looked up by name, so a steady update doesn't pay for a token fetch, a tls
+// handshake and a zone lookup each time. Entries are keyed by a hash of the credentials they were
+// made with, expire after a while so rotated or revoked credentials are picked up again and the
+// least recently used are evicted once the cache is full
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+const (
+	// clientCacheTTL is how long a client is reused, the sdks refresh their own tokens inside it
+	clientCacheTTL = time.Hour
+	// zoneCacheTTL is how long a zone id looked up by name is trusted
+	zoneCacheTTL = time.Hour
+	// cacheSize is how many entries are kept before the least recently used are evicted
+	cacheSize = 256
+)
+
+type cacheEntry struct {
+	value    any
+	expires  time.Time
+	lastUsed time.Time
+}
+
+var clientCache = struct {
+	sync.Mutex
+	entries map[string]*cacheEntry
+}{entries: make(map[string]*cacheEntry)}
+
+// cacheKey hashes the values a cached entry depends on, so credentials aren't kept as map keys
+func cacheKey(kind string, values ...string) string {
+	hash := sha256.New()
+	for _, value := range values {
+		hash.Write([]byte(value))
+		hash.Write([]byte{0})
+	}
+	return kind + ":" + hex.EncodeToString(hash.Sum(nil))
+}
+
+// settingValues returns the values of keys in settings in order, for building a cache key
+func settingValues(settings map[string]string, keys ...string) []string {
+	var values []string
+	for _, key := range keys {
+		values = append(values, settings[key])
+	}
+	return values
+}
+
+// cached returns the entry for key, building and storing it when it's missing or has expired,
+// errors are never cached
+func cached[T any](key string, ttl time.Duration, build func() (T, error)) (T, error) {
+	now := time.Now()
+	clientCache.Lock()
+	if entry, found := clientCache.entries[key]; found && now.Before(entry.expires) {
+		entry.lastUsed = now
+		clientCache.Unlock()
+		return entry.value.(T), nil
+	}
+	clientCache.Unlock()
+
+	// two requests can build the same entry at once, the last one stored wins which is harmless
+	value, err := build()
+	if err != nil {
+		return value, err
+	}
+
+	clientCache.Lock()
+	defer clientCache.Unlock()
+	for key, entry := range clientCache.entries {
+		if !now.Before(entry.expires) {
+			delete(clientCache.entries, key)
+		}
+	}
+	for len(clientCache.entries) >= cacheSize {
+		var oldest string
+		for key, entry := range clientCache.entries {
+			if oldest == "" || entry.lastUsed.Before(clientCache.entries[oldest].lastUsed) {
+				oldest = key
+			}
+		}
+		delete(clientCache.entries, oldest)
+	}
+	clientCache.entries[key] = &cacheEntry{value: value, expires: now.Add(ttl), lastUsed: now}
+	return value, nil
+}
+
+// forgetCached drops an entry that turned out to be wrong, ie a zone that has since been deleted
+func forgetCached(key string) {
+	clientCache.Lock()
+	defer clientCache.Unlock()
+	delete(clientCache.entries, key)
+}
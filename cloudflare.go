@@ -3,79 +3,210 @@ package main
 import (
 	"context"
 	"errors"
-	"net/http"
+	"fmt"
+	"strings"
+	"time"
 
 	"github.com/cloudflare/cloudflare-go"
+	"github.com/miekg/dns"
 )
 
-func cfHandler(w http.ResponseWriter, r *http.Request) {
+// cfManagedComment starts the comment put on the records cloud-ddns writes, a comment that doesn't
+// start with it was written by someone else and is kept
+const cfManagedComment = "managed by cloud-ddns"
 
-	client := r.Header.Get("X-Forwarded-For")
-	if client == "" {
-		client = r.RemoteAddr
-	}
+// cfCredentialSettings are the settings a cloudflare client is made from
+var cfCredentialSettings = []string{"token", "email", "apikey"}
 
-	ip, hostname, err := checkForms(r)
+func cfUpdate(ctx context.Context, settings map[string]string, update *dnsUpdate) error {
+	multi, err := multiValue(settings)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		logger("client: "+client+" "+err.Error(), "err")
+		return err
 	}
-	// fmt.Println(ip, hostname)
-
-	// CF Is a much simpler api/package so it will all e done in this one step
-	err = cfDoUpdate(user, pass, hostname, ip)
+	// proxied is only changed when it's asked for, otherwise records keep what they had
+	var proxied *bool
+	if settings["proxied"] != "" {
+		value, err := settingBool(settings, "proxied")
+		if err != nil {
+			return err
+		}
+		proxied = &value
+	}
+	api, err := cfSetup(settings)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		logger("client: "+client+" "+err.Error(), "err")
+		return err
+	}
+	// without a zone name the zone is found from the hostname, so one token can cover many zones
+	var zoneKey string
+	var zoneId string
+	if settings["zone"] != "" {
+		if !dns.IsSubDomain(settings["zone"], update.hostname) {
+			return newDyndnsError(dyndnsNoHost, "hostname "+update.hostname+" does not belong to zone "+settings["zone"])
+		}
+		zoneKey = cacheKey("cloudflare-zone", append(settingValues(settings, cfCredentialSettings...), settings["zone"])...)
+		zoneId, err = cached(zoneKey, zoneCacheTTL, func() (string, error) {
+			return cfZoneID(api, settings["zone"])
+		})
 	} else {
-		w.WriteHeader(200)
-		w.Write([]byte("OK\n"))
-		logger("client: "+client+" succesfully updated Cloudflare DNS hostname: "+hostname+" ip: "+ip, "info")
+		zoneKey = cacheKey("cloudflare-hostname", append(settingValues(settings, cfCredentialSettings...), hostKey(update.hostname))...)
+		zoneId, err = cached(zoneKey, zoneCacheTTL, func() (string, error) {
+			return cfFindZone(ctx, api, update.hostname)
+		})
+	}
+	if err != nil {
+		return err
+	}
+
+	// CF Is a much simpler api/package so it will all e done in this one step
+	values := managedValues(update, multi)
+	for _, recType := range []string{"A", "AAAA"} {
+		if len(values[recType]) == 0 {
+			continue
+		}
+		err := cfDoUpdate(ctx, api, zoneId, update.hostname, recType, values[recType], update.ttl, multi, proxied)
+		if err != nil {
+			// the zone may have been deleted since it was cached, look it up again next time
+			if classifyError(err) == errorNotFound {
+				forgetCached(zoneKey)
+			}
+			return err
+		}
 	}
+	return nil
+}
 
+// cfSetup returns the api client for the credentials, a scoped api token or a global api key with
+// the account email, which either come from the server config or are passed through as
+// "email:apikey" in place of the token, clients are reused across requests
+func cfSetup(settings map[string]string) (*cloudflare.API, error) {
+	email, apiKey := settings["email"], settings["apikey"]
+	if apiKey == "" {
+		if tokenEmail, tokenKey, found := strings.Cut(settings["token"], ":"); found {
+			email, apiKey = tokenEmail, tokenKey
+		}
+	}
+	return cached(cacheKey("cloudflare", settings["token"], email, apiKey), clientCacheTTL, func() (*cloudflare.API, error) {
+		// retries are done by withRetry so they fit in the request deadline
+		var api *cloudflare.API
+		var err error
+		if apiKey != "" {
+			api, err = cloudflare.New(apiKey, email, cloudflare.UsingRetryPolicy(0, 1, 1))
+		} else {
+			api, err = cloudflare.NewWithAPIToken(settings["token"], cloudflare.UsingRetryPolicy(0, 1, 1))
+		}
+		if err != nil {
+			return nil, errors.New("failed to create cloudfare api session")
+		}
+		return api, nil
+	})
 }
 
-func cfDoUpdate(zoneName, apiToken, hostname, ip string) error {
-	api, err := cloudflare.NewWithAPIToken(apiToken)
+func cfZoneID(api *cloudflare.API, zoneName string) (string, error) {
+	zoneId, err := api.ZoneIDByName(zoneName)
 	if err != nil {
-		return errors.New("failed to create cloudfare api session")
+		// an outage or bad token isn't a missing zone, only report nohost when the lookup worked
+		if class := classifyError(err); class != errorUnknown && class != errorNotFound {
+			return "", fmt.Errorf("failed to look up zone: %w", err)
+		}
+		return "", newDyndnsError(dyndnsNoHost, "zoneName not found (should be provided as username in cloudflare mode)")
 	}
-	zoneId, err := api.ZoneIDByName(zoneName)
+	return zoneId, nil
+}
+
+// cfFindZone returns the id of the zone with the longest name that hostname is in, out of the
+// zones the credentials can see, every parent of hostname is looked up by name
+func cfFindZone(ctx context.Context, api *cloudflare.API, hostname string) (string, error) {
+	labels := dns.SplitDomainName(hostname)
+	var names []string
+	// a top level domain is never a zone so the last label alone isn't looked up
+	for i := 0; i < len(labels)-1; i++ {
+		names = append(names, strings.Join(labels[i:], "."))
+	}
+	if len(names) == 0 {
+		return "", newDyndnsError(dyndnsNotFQDN, "hostname "+hostname+" is not a fully qualified domain name")
+	}
+	zones, err := api.ListZones(ctx, names...)
 	if err != nil {
-		return errors.New("zoneName not found (should be provided as username in cloudflare mode)")
+		return "", fmt.Errorf("failed to list zones: %w", err)
+	}
+	var found cloudflare.Zone
+	for _, zone := range zones {
+		if dns.IsSubDomain(zone.Name, hostname) && len(zone.Name) > len(found.Name) {
+			found = zone
+		}
+	}
+	if found.ID == "" {
+		return "", newDyndnsError(dyndnsNoHost, "no zone the credentials can access covers hostname "+hostname)
 	}
+	return found.ID, nil
+}
+
+func cfDoUpdate(ctx context.Context, api *cloudflare.API, zoneId, hostname, recType string, ips []string, ttl int, multi bool, proxied *bool) error {
+	zone := cloudflare.ZoneIdentifier(zoneId)
+	comment := cfManagedComment + " " + time.Now().UTC().Format(time.RFC3339)
 
-	// Check if DNS Record exists
-	records, _, err := api.ListDNSRecords(context.Background(), cloudflare.ZoneIdentifier(zoneId), cloudflare.ListDNSRecordsParams{Name: hostname})
+	// Check which DNS Records exist
+	records, _, err := api.ListDNSRecords(ctx, zone, cloudflare.ListDNSRecordsParams{Name: hostname, Type: recType})
 	if err != nil {
 		// there was an error checking for the record
 		return err
-	} else {
-		// DNS Record was found probably lets just double check the value is populated
-		if len(records) == 0 {
-			// record not actually found
-			// Ok so there is no record found, lets then create a new DNS entry
-			record := cloudflare.CreateDNSRecordParams{
-				Type:    "A",
-				Name:    hostname,
-				Content: ip,
-			}
-			_, err = api.CreateDNSRecord(context.TODO(), cloudflare.ZoneIdentifier(zoneId), record)
-			if err != nil {
-				return err
-			}
-		} else {
-			recordId := records[0].ID
-			record := cloudflare.UpdateDNSRecordParams{
-				Type:    "A",
-				Name:    hostname,
-				Content: ip,
-				ID:      recordId,
-			}
-			_, err = api.UpdateDNSRecord(context.TODO(), cloudflare.ZoneIdentifier(zoneId), record)
-			if err != nil {
-				return err
-			}
+	}
+	var existing []string
+	for _, record := range records {
+		existing = append(existing, record.Content)
+	}
+
+	// records are updated and created before the extras are deleted so the name always resolves
+	plan := planRecords(existing, ips, multi)
+	for _, change := range plan.update {
+		// an update replaces the whole record, so anything not set here is carried over or it
+		// would be reset, ie an orange clouded record would stop being proxied
+		existing := records[change.index]
+		record := cloudflare.UpdateDNSRecordParams{
+			Type:    recType,
+			Name:    hostname,
+			Content: change.value,
+			TTL:     ttl,
+			ID:      existing.ID,
+			Proxied: existing.Proxied,
+			Tags:    existing.Tags,
+		}
+		if proxied != nil {
+			record.Proxied = proxied
+		}
+		if existing.Comment == "" || strings.HasPrefix(existing.Comment, cfManagedComment) {
+			record.Comment = &comment
+		}
+		if record.Proxied != nil && *record.Proxied {
+			// proxied records always have an automatic ttl
+			record.TTL = 1
+		}
+		_, err = api.UpdateDNSRecord(ctx, zone, record)
+		if err != nil {
+			return err
+		}
+	}
+	for _, ip := range plan.create {
+		record := cloudflare.CreateDNSRecordParams{
+			Type:    recType,
+			Name:    hostname,
+			Content: ip,
+			TTL:     ttl,
+			Proxied: proxied,
+			Comment: comment,
+		}
+		if proxied != nil && *proxied {
+			record.TTL = 1
+		}
+		_, err = api.CreateDNSRecord(ctx, zone, record)
+		if err != nil {
+			return err
+		}
+	}
+	for _, index := range plan.remove {
+		err = api.DeleteDNSRecord(ctx, zone, records[index].ID)
+		if err != nil {
+			return fmt.Errorf("failed to delete duplicate record: %w", err)
 		}
 	}
 
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/cloudflare/cloudflare-go"
+)
+
+func TestCloudflareConverge(t *testing.T) {
+	tests := []struct {
+		name     string
+		ips      []string
+		multi    bool
+		want     []string
+		wantBody map[string]string
+	}{
+		{"duplicate and stale records", []string{"192.0.2.1", "192.0.2.2"}, false,
+			[]string{"GET /zones/z1/dns_records", "PATCH /zones/z1/dns_records/r1", "PATCH /zones/z1/dns_records/r2", "DELETE /zones/z1/dns_records/r3"},
+			map[string]string{"r1": "192.0.2.1", "r2": "192.0.2.2"}},
+		{"multi leaves the extras alone", []string{"192.0.2.2"}, true,
+			[]string{"GET /zones/z1/dns_records", "PATCH /zones/z1/dns_records/r1"},
+			map[string]string{"r1": "192.0.2.2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var endpoint string
+			mock := startMockAPI(t, &endpoint, func(w http.ResponseWriter, call apiCall) {
+				if call.method == "GET" {
+					w.Write([]byte(`{"success":true,"errors":[],"messages":[],"result":[
+						{"id":"r1","type":"A","name":"home.example.com","content":"192.0.2.1"},
+						{"id":"r2","type":"A","name":"home.example.com","content":"192.0.2.9"},
+						{"id":"r3","type":"A","name":"home.example.com","content":"192.0.2.1"}],
+						"result_info":{"page":1,"per_page":100,"count":3,"total_count":3,"total_pages":1}}`))
+					return
+				}
+				w.Write([]byte(`{"success":true,"errors":[],"messages":[],"result":{"id":"r"}}`))
+			})
+			api, err := cloudflare.NewWithAPIToken("token", cloudflare.BaseURL(endpoint), cloudflare.UsingRetryPolicy(0, 1, 1), cloudflare.UsingRateLimit(1000))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = cfDoUpdate(t.Context(), api, "z1", "home.example.com", "A", test.ips, 300, test.multi, nil)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := mock.requests(); !slices.Equal(got, test.want) {
+				t.Errorf("requests = %v, want %v", got, test.want)
+			}
+			for _, call := range mock.received() {
+				if call.method != "PATCH" {
+					continue
+				}
+				var record cloudflare.DNSRecord
+				json.Unmarshal([]byte(call.body), &record)
+				id := call.path[strings.LastIndex(call.path, "/")+1:]
+				if record.Content != test.wantBody[id] {
+					t.Errorf("%s content = %q, want %q", id, record.Content, test.wantBody[id])
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+// This file serializes updates to the same hostname, routers tend to send a burst of updates when
+// they reconnect and ha pairs both update the same name, left to race two creates at once can
+// leave duplicate records behind. Updates to a hostname are applied one at a time in the order they
+// arrived so the last one received is the one that sticks, and a request identical to the one
+// last in line shares its provider call rather than making another
+
+import (
+	"context"
+	"maps"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// hostFlight is one provider call for a hostname, every request identical to it waits on done and
+// gets the same err
+type hostFlight struct {
+	identity string
+	done     chan struct{}
+	err      error
+	// shared counts the identical requests that joined the flight, it's changed with hostLines held
+	shared int
+}
+
+// hostLines holds the flights for each line and hostname in arrival order, the first one is
+// running and each of the others waits for the one in front of it
+var hostLines = struct {
+	sync.Mutex
+	lines map[string][]*hostFlight
+}{lines: make(map[string][]*hostFlight)}
+
+// updateIdentity describes an update completely, two requests with the same identity would make
+// exactly the same change
+func updateIdentity(route string, settings map[string]string, update *dnsUpdate) string {
+	var identity strings.Builder
+	identity.WriteString(route)
+	for _, key := range slices.Sorted(maps.Keys(settings)) {
+		identity.WriteString("\x00" + key + "=" + settings[key])
+	}
+	identity.WriteString("\x00" + strings.Join(update.ips, ",") + "\x00" + strconv.Itoa(update.ttl))
+	return identity.String()
+}
+
+// coalesce runs apply once it's the update's turn for the hostname in line, or waits for the
+// result of an identical update when it's the last one in line, a request that runs out of time
+// while waiting gives up without running apply. line is the provider name for provider routes and
+// the target name for configured hosts, so two targets on the same provider still run in parallel
+func coalesce(ctx context.Context, line, identity string, update *dnsUpdate, apply func() error) error {
+	lineKey := line + "\x00" + hostKey(update.hostname)
+
+	hostLines.Lock()
+	flights := hostLines.lines[lineKey]
+	if len(flights) > 0 && flights[len(flights)-1].identity == identity {
+		flight := flights[len(flights)-1]
+		flight.shared++
+		hostLines.Unlock()
+		select {
+		case <-flight.done:
+			return flight.err
+		case <-ctx.Done():
+			return classifiedError(ctx.Err())
+		}
+	}
+	flight := &hostFlight{identity: identity, done: make(chan struct{})}
+	hostLines.lines[lineKey] = append(flights, flight)
+	hostLines.Unlock()
+
+	if len(flights) > 0 {
+		ahead := flights[len(flights)-1]
+		select {
+		case <-ahead.done:
+		case <-ctx.Done():
+			// the flight keeps its place until the one ahead finishes so the ones behind it still
+			// run one at a time
+			flight.err = classifiedError(ctx.Err())
+			go func() {
+				<-ahead.done
+				leaveLine(lineKey, flight)
+			}()
+			return flight.err
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		flight.err = classifiedError(err)
+	} else {
+		flight.err = apply()
+	}
+	leaveLine(lineKey, flight)
+	return flight.err
+}
+
+// leaveLine takes the finished flight at the front of its line off it and lets the next one go
+func leaveLine(lineKey string, flight *hostFlight) {
+	hostLines.Lock()
+	flights := hostLines.lines[lineKey][1:]
+	if len(flights) == 0 {
+		delete(hostLines.lines, lineKey)
+	} else {
+		hostLines.lines[lineKey] = flights
+	}
+	hostLines.Unlock()
+	close(flight.done)
+}
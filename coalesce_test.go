@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCoalesceLines(t *testing.T) {
+	ctx := context.Background()
+
+	// two targets on the same provider are separate lines, both are running before either finishes
+	update := &dnsUpdate{hostname: "home.example.com", ips: []string{"192.0.2.1"}, ttl: 300}
+	started := make(chan struct{}, 2)
+	release := make(chan struct{})
+	var wg sync.WaitGroup
+	for _, line := range []string{"target cloudflare-a", "target cloudflare-b"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			coalesce(ctx, line, line, update, func() error {
+				started <- struct{}{}
+				<-release
+				return nil
+			})
+		}()
+	}
+	for range 2 {
+		select {
+		case <-started:
+		case <-time.After(5 * time.Second):
+			t.Fatal("updates on different lines were serialized")
+		}
+	}
+	close(release)
+	wg.Wait()
+
+	// different updates on one line run one at a time in arrival order, each caller is started once
+	// the one before it is in line
+	update = &dnsUpdate{hostname: "order.example.com", ips: []string{"192.0.2.1"}, ttl: 300}
+	release = make(chan struct{})
+	var running, overlapped atomic.Int32
+	var order []string
+	var mu sync.Mutex
+	for i, identity := range []string{"first", "second", "third"} {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			coalesce(ctx, "cloudflare", identity, update, func() error {
+				if running.Add(1) > 1 {
+					overlapped.Store(1)
+				}
+				<-release
+				mu.Lock()
+				order = append(order, identity)
+				mu.Unlock()
+				running.Add(-1)
+				return nil
+			})
+		}()
+		waitForLine(t, "cloudflare", update.hostname, i+1)
+	}
+	close(release)
+	wg.Wait()
+	if overlapped.Load() != 0 {
+		t.Error("updates on the same line overlapped")
+	}
+	if len(order) != 3 || order[0] != "first" || order[1] != "second" || order[2] != "third" {
+		t.Errorf("applied in order %v, want first second third", order)
+	}
+
+	// an identical update last in line shares its call
+	update = &dnsUpdate{hostname: "same.example.com", ips: []string{"192.0.2.1"}, ttl: 300}
+	release = make(chan struct{})
+	var calls atomic.Int32
+	results := make(chan error, 2)
+	for range 2 {
+		go func() {
+			results <- coalesce(ctx, "cloudflare", "same", update, func() error {
+				calls.Add(1)
+				<-release
+				return errNoChange
+			})
+		}()
+	}
+	waitForShared(t, "cloudflare", update.hostname, 1)
+	close(release)
+	for range 2 {
+		if err := <-results; err != errNoChange {
+			t.Errorf("err = %v, want the shared result", err)
+		}
+	}
+	if calls.Load() != 1 {
+		t.Errorf("apply ran %d times, want 1", calls.Load())
+	}
+}
+
+// waitForLine waits until the line for hostname holds n flights
+func waitForLine(t *testing.T, line, hostname string, n int) {
+	t.Helper()
+	key := line + "\x00" + hostKey(hostname)
+	for range 5000 {
+		hostLines.Lock()
+		length := len(hostLines.lines[key])
+		hostLines.Unlock()
+		if length == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("line %s never held %d flights", line, n)
+}
+
+func TestCoalesceWaiterDeadline(t *testing.T) {
+	update := &dnsUpdate{hostname: "slow.example.com", ips: []string{"192.0.2.1"}, ttl: 300}
+	release := make(chan struct{})
+	first := make(chan error)
+	go func() {
+		first <- coalesce(context.Background(), "aws", "first", update, func() error {
+			<-release
+			return nil
+		})
+	}()
+	waitForLine(t, "aws", update.hostname, 1)
+
+	// both a different update and one sharing the call give up at their own deadline
+	for _, identity := range []string{"first", "second"} {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		err := coalesce(ctx, "aws", identity, update, func() error {
+			t.Errorf("%s applied while the flight ahead was still running", identity)
+			return nil
+		})
+		cancel()
+		if classifyError(err) != errorTransient {
+			t.Errorf("%s: err = %v, want 911", identity, err)
+		}
+	}
+
+	// the update that gave up keeps its place until the one ahead is done, then the line empties
+	close(release)
+	if err := <-first; err != nil {
+		t.Errorf("first: err = %v, want nil", err)
+	}
+	waitForLine(t, "aws", update.hostname, 0)
+}
+
+// waitForShared waits until the flight at the front of the line for hostname has been joined by
+// shared identical requests
+func waitForShared(t *testing.T, line, hostname string, shared int) {
+	t.Helper()
+	key := line + "\x00" + hostKey(hostname)
+	for range 5000 {
+		hostLines.Lock()
+		flights := hostLines.lines[key]
+		joined := len(flights) > 0 && flights[0].shared == shared
+		hostLines.Unlock()
+		if joined {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("line %s never had %d shared requests", line, shared)
+}
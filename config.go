@@ -0,0 +1,149 @@
+package main
+
+// This file contains the optional server side config, it lets provider credentials live on the
+// server so routers only have to send a username and password of their own instead of api keys
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"os"
+)
+
+// default location of the config file, can be overridden with the CLOUD_DDNS_CONFIG env var
+const defaultConfigFile = "/etc/cloud-ddns/config.json"
+
+// Config is the layout of the json config file
+type Config struct {
+	// Clients are keyed by the basic auth username the client sends
+	Clients map[string]*ClientConfig `json:"clients"`
+	// HTTP are the request templates for the generic http provider, keyed by the name used in
+	// the url ie /http/ipam/
+	HTTP map[string]*HTTPProvider `json:"http"`
+	// Exec are the external programs for the exec provider, keyed by the name used in the url
+	// ie /exec/myprovider/
+	Exec map[string]*ExecProvider `json:"exec"`
+	// Zonefiles are the BIND zone files the zonefile provider may write, keyed by the name used
+	// in the url ie /zonefile/lab/
+	Zonefiles map[string]*ZoneFile `json:"zonefiles"`
+	// DNSServer starts the embedded authoritative dns server for a delegated subzone
+	DNSServer *DNSServerConfig `json:"dnsServer"`
+	// Targets are providers with their settings that hosts are written to, keyed by a name of
+	// your choosing ie "route53-primary"
+	Targets map[string]*Target `json:"targets"`
+	// Hosts are the hostnames updated through /nic/update and the targets each is mirrored to
+	Hosts map[string]*HostConfig `json:"hosts"`
+	// Health sets when a failing target's circuit opens and for how long
+	Health *HealthConfig `json:"health"`
+	// Retry sets how provider errors that might be transient are retried
+	Retry *RetryConfig `json:"retry"`
+	// Async queues updates on disk and answers straight away, workers apply them in the background
+	Async *AsyncConfig `json:"async"`
+}
+
+// ClientConfig holds a client's password and the settings to use for each provider, keyed by
+// provider name ie "linode": {"domain": "example.com", "token": "..."}
+type ClientConfig struct {
+	Password  string                       `json:"password"`
+	Providers map[string]map[string]string `json:"providers"`
+}
+
+var config = &Config{}
+
+func configFile() string {
+	if path := os.Getenv("CLOUD_DDNS_CONFIG"); path != "" {
+		return path
+	}
+	return defaultConfigFile
+}
+
+func loadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		// the config is optional, without one every provider works with pass-through credentials
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	newConfig := &Config{}
+	err = json.Unmarshal(data, newConfig)
+	if err != nil {
+		return errors.New("failed to parse " + path + ": " + err.Error())
+	}
+	// every section is checked and has its defaults filled in here, so a broken entry stops
+	// cloud-ddns from starting rather than failing updates later
+	for name, h := range newConfig.HTTP {
+		err = h.compile(name)
+		if err != nil {
+			return errors.New("invalid http provider " + name + ": " + err.Error())
+		}
+	}
+	for name, e := range newConfig.Exec {
+		err = e.compile(name)
+		if err != nil {
+			return err
+		}
+	}
+	for name, z := range newConfig.Zonefiles {
+		err = z.compile(name)
+		if err != nil {
+			return err
+		}
+	}
+	if newConfig.DNSServer != nil {
+		err = newConfig.DNSServer.compile()
+		if err != nil {
+			return err
+		}
+	}
+	if newConfig.Async != nil {
+		err = newConfig.Async.compile()
+		if err != nil {
+			return err
+		}
+	}
+	if newConfig.Retry != nil {
+		err = newConfig.Retry.compile()
+		if err != nil {
+			return err
+		}
+	}
+	if newConfig.Health != nil {
+		err = newConfig.Health.compile()
+		if err != nil {
+			return err
+		}
+	}
+	for name, t := range newConfig.Targets {
+		err = t.compile(name)
+		if err != nil {
+			return err
+		}
+	}
+	hosts := make(map[string]*HostConfig)
+	for hostname, h := range newConfig.Hosts {
+		err = h.compile(hostname, newConfig.Targets)
+		if err != nil {
+			return err
+		}
+		hosts[hostKey(hostname)] = h
+	}
+	newConfig.Hosts = hosts
+	config = newConfig
+	logger("loaded config from "+path, "info")
+	return nil
+}
+
+// configClient returns the configured client username and password belong to, or nil when they
+// don't match one, callers passing credentials through check the username isn't configured first
+func configClient(username, password string) *ClientConfig {
+	client, found := config.Clients[username]
+	if !found {
+		return nil
+	}
+	if subtle.ConstantTimeCompare([]byte(client.Password), []byte(password)) != 1 {
+		return nil
+	}
+	return client
+}
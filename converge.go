@@ -0,0 +1,96 @@
+package main
+
+// This file works out how to make the records of a name and type match an update exactly, for the
+// providers that keep one record per value rather than whole rrsets. Duplicates left behind by
+// races or manual edits are updated to the requested values or deleted, unless the "multivalue"
+// setting says the zone keeps extra values on purpose, then only the first record is touched
+
+import (
+	"net"
+	"slices"
+)
+
+// recordChange sets the existing record at index to value
+type recordChange struct {
+	index int
+	value string
+}
+
+// recordPlan is what it takes for a set of existing records to hold exactly the wanted values,
+// indexes are into the existing records
+type recordPlan struct {
+	update []recordChange
+	create []string
+	remove []int
+}
+
+// multiValue reads the "multivalue" setting, when it's set extra records are left alone
+func multiValue(settings map[string]string) (bool, error) {
+	return settingBool(settings, "multivalue")
+}
+
+// managedValues returns the values to write for each record type, every address when converging
+// and just the first of each type when extra records are left alone
+func managedValues(update *dnsUpdate, multi bool) map[string][]string {
+	byType := ipsByType(update.ips)
+	if multi {
+		for fieldType, ips := range byType {
+			byType[fieldType] = ips[:1]
+		}
+	}
+	return byType
+}
+
+// planRecords matches the wanted values to the existing ones, records that already hold a wanted
+// value keep it, the rest are reused for the remaining values before new ones are created and
+// whatever is left over is removed, with multi only the first record is considered at all
+func planRecords(existing, wanted []string, multi bool) recordPlan {
+	if multi && len(existing) > 1 {
+		existing = existing[:1]
+	}
+	var plan recordPlan
+	assigned := make([]bool, len(existing))
+	var unplaced []string
+	for i, value := range wanted {
+		if slices.ContainsFunc(wanted[:i], func(seen string) bool { return sameIP(seen, value) }) {
+			continue
+		}
+		match := -1
+		for j, current := range existing {
+			if !assigned[j] && sameIP(current, value) {
+				match = j
+				break
+			}
+		}
+		if match == -1 {
+			unplaced = append(unplaced, value)
+			continue
+		}
+		assigned[match] = true
+		plan.update = append(plan.update, recordChange{index: match, value: value})
+	}
+	for _, value := range unplaced {
+		free := slices.Index(assigned, false)
+		if free == -1 {
+			plan.create = append(plan.create, value)
+			continue
+		}
+		assigned[free] = true
+		plan.update = append(plan.update, recordChange{index: free, value: value})
+	}
+	for i, used := range assigned {
+		if !used {
+			plan.remove = append(plan.remove, i)
+		}
+	}
+	return plan
+}
+
+// sameIP compares addresses rather than strings so an ipv6 address written out differently still matches
+func sameIP(a, b string) bool {
+	ipA, ipB := net.ParseIP(a), net.ParseIP(b)
+	if ipA == nil || ipB == nil {
+		return a == b
+	}
+	return ipA.Equal(ipB)
+}
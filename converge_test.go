@@ -0,0 +1,47 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestPlanRecords(t *testing.T) {
+	tests := []struct {
+		name     string
+		existing []string
+		wanted   []string
+		multi    bool
+		want     recordPlan
+	}{
+		{"empty existing set creates every value", nil, []string{"192.0.2.1", "192.0.2.2"}, false,
+			recordPlan{create: []string{"192.0.2.1", "192.0.2.2"}}},
+		{"record already holding the value keeps it", []string{"192.0.2.1"}, []string{"192.0.2.1"}, false,
+			recordPlan{update: []recordChange{{0, "192.0.2.1"}}}},
+		{"duplicates of the wanted value are removed", []string{"192.0.2.1", "192.0.2.1", "192.0.2.1"}, []string{"192.0.2.1"}, false,
+			recordPlan{update: []recordChange{{0, "192.0.2.1"}}, remove: []int{1, 2}}},
+		{"stale extras are removed", []string{"192.0.2.9", "192.0.2.1", "192.0.2.8"}, []string{"192.0.2.1"}, false,
+			recordPlan{update: []recordChange{{1, "192.0.2.1"}}, remove: []int{0, 2}}},
+		{"record is reused for a changed value", []string{"192.0.2.9"}, []string{"192.0.2.1"}, false,
+			recordPlan{update: []recordChange{{0, "192.0.2.1"}}}},
+		{"matching records are kept before free ones are reused", []string{"192.0.2.9", "192.0.2.2"}, []string{"192.0.2.1", "192.0.2.2"}, false,
+			recordPlan{update: []recordChange{{1, "192.0.2.2"}, {0, "192.0.2.1"}}}},
+		{"more values than records creates the rest", []string{"192.0.2.1"}, []string{"192.0.2.3", "192.0.2.1", "192.0.2.2"}, false,
+			recordPlan{update: []recordChange{{0, "192.0.2.1"}}, create: []string{"192.0.2.3", "192.0.2.2"}}},
+		{"ipv6 written out differently matches", []string{"2001:0db8:0000:0000::0001", "2001:db8::2"}, []string{"2001:db8::1"}, false,
+			recordPlan{update: []recordChange{{0, "2001:db8::1"}}, remove: []int{1}}},
+		{"repeated wanted value is only written once", nil, []string{"192.0.2.1", "192.0.2.1"}, false,
+			recordPlan{create: []string{"192.0.2.1"}}},
+		{"multi only touches the first record", []string{"192.0.2.9", "192.0.2.1", "192.0.2.8"}, []string{"192.0.2.1"}, true,
+			recordPlan{update: []recordChange{{0, "192.0.2.1"}}}},
+		{"multi with nothing there creates", nil, []string{"192.0.2.1"}, true,
+			recordPlan{create: []string{"192.0.2.1"}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := planRecords(test.existing, test.wanted, test.multi)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("plan = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
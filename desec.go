@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+var desecEndpoint = "https://desec.io/api/v1"
+
+// deSEC's default minimum ttl, each domain reports its own which is used when it can be read, its
+// rate limiting is handled by the retries every provider gets
+const desecMinTTL = 3600
+
+// deSEC Domain structure, only the fields we need
+type DesecDomain struct {
+	Name       string `json:"name"`
+	MinimumTTL int    `json:"minimum_ttl"`
+}
+
+// deSEC RRSet structure, an empty records list deletes the rrset
+type DesecRRSet struct {
+	Subname string   `json:"subname"`
+	Type    string   `json:"type"`
+	TTL     int      `json:"ttl"`
+	Records []string `json:"records"`
+}
+
+func desecUpdate(ctx context.Context, settings map[string]string, update *dnsUpdate) error {
+	// domain name as username and api token as password
+	return desecDoUpdate(ctx, settings["domain"], settings["token"], update.hostname, update.ips, update.ttl)
+}
+
+func desecDoUpdate(ctx context.Context, domain, apiToken, hostname string, ips []string, ttl int) error {
+	headers := map[string]string{"Authorization": "Token " + apiToken}
+	domainPath := desecEndpoint + "/domains/" + url.PathEscape(domain) + "/"
+
+	subname, err := subdomainOf(hostname, domain)
+	if err != nil {
+		return err
+	}
+
+	// deSEC refuses ttls below the domain's minimum, so read it and raise the ttl to match
+	var domainInfo DesecDomain
+	err = apiRequest(ctx, "deSEC", "GET", domainPath, headers, nil, &domainInfo)
+	if err != nil {
+		return fmt.Errorf("failed to look up domain: %w", err)
+	}
+	minTTL := domainInfo.MinimumTTL
+	if minTTL == 0 {
+		minTTL = desecMinTTL
+	}
+	if ttl < minTTL {
+		ttl = minTTL
+	}
+
+	// A and AAAA go together in one bulk PATCH so both change at the same time, a record type that
+	// isn't in the request is left out rather than sent empty which would delete it
+	var rrsets []DesecRRSet
+	byType := ipsByType(ips)
+	for _, fieldType := range []string{"A", "AAAA"} {
+		if len(byType[fieldType]) == 0 {
+			continue
+		}
+		rrsets = append(rrsets, DesecRRSet{Subname: subname, Type: fieldType, TTL: ttl, Records: byType[fieldType]})
+	}
+
+	err = apiRequest(ctx, "deSEC", "PATCH", domainPath+"rrsets/", headers, rrsets, nil)
+	if err != nil {
+		return fmt.Errorf("failed to update DNS records: %w", err)
+	}
+
+	return nil
+}
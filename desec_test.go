@@ -0,0 +1,56 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestDesecUpdate(t *testing.T) {
+	tests := []struct {
+		name       string
+		minimumTTL int
+		hostname   string
+		ips        []string
+		ttl        int
+		wantSets   []DesecRRSet
+	}{
+		{"both types in one patch", 60, "home.example.com", []string{"192.0.2.1", "2001:db8::1", "192.0.2.2"}, 300,
+			[]DesecRRSet{{Subname: "home", Type: "A", TTL: 300, Records: []string{"192.0.2.1", "192.0.2.2"}}, {Subname: "home", Type: "AAAA", TTL: 300, Records: []string{"2001:db8::1"}}}},
+		{"missing type left out and ttl raised to the domain minimum", 3600, "example.com", []string{"2001:db8::1"}, 300,
+			[]DesecRRSet{{Subname: "", Type: "AAAA", TTL: 3600, Records: []string{"2001:db8::1"}}}},
+		{"default minimum when the domain doesn't say", 0, "home.example.com", []string{"192.0.2.1"}, 60,
+			[]DesecRRSet{{Subname: "home", Type: "A", TTL: desecMinTTL, Records: []string{"192.0.2.1"}}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := startMockAPI(t, &desecEndpoint, func(w http.ResponseWriter, call apiCall) {
+				if call.method == "GET" {
+					json.NewEncoder(w).Encode(DesecDomain{Name: "example.com", MinimumTTL: test.minimumTTL})
+					return
+				}
+				w.Write([]byte(`[]`))
+			})
+			err := desecDoUpdate(t.Context(), "example.com", "token", test.hostname, test.ips, test.ttl)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			want := []string{"GET /domains/example.com/", "PATCH /domains/example.com/rrsets/"}
+			if got := mock.requests(); !slices.Equal(got, want) {
+				t.Errorf("requests = %v, want %v", got, want)
+			}
+			patch := mock.last()
+			if patch.header.Get("Authorization") != "Token token" {
+				t.Errorf("Authorization = %q", patch.header.Get("Authorization"))
+			}
+			var rrsets []DesecRRSet
+			json.Unmarshal([]byte(patch.body), &rrsets)
+			if !slices.EqualFunc(rrsets, test.wantSets, func(a, b DesecRRSet) bool {
+				return a.Subname == b.Subname && a.Type == b.Type && a.TTL == b.TTL && slices.Equal(a.Records, b.Records)
+			}) {
+				t.Errorf("rrsets = %+v, want %+v", rrsets, test.wantSets)
+			}
+		})
+	}
+}
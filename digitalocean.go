@@ -2,95 +2,102 @@ package main
 
 import (
 	"context"
-	"errors"
-	"net/http"
-	"strings"
+	"fmt"
 
 	"github.com/digitalocean/godo"
 )
 
-func doHandler(w http.ResponseWriter, r *http.Request) {
-
-	client := r.Header.Get("X-Forwarded-For")
-	if client == "" {
-		client = r.RemoteAddr
-	}
-
-	ip, hostname, err := checkForms(r)
+func doUpdate(ctx context.Context, settings map[string]string, update *dnsUpdate) error {
+	multi, err := multiValue(settings)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		logger("client: "+client+" "+err.Error(), "err")
-		return
+		return err
 	}
-
-	// DigitalOcean DNS API is straightforward like Cloudflare
-	err = doDoUpdate(user, pass, hostname, ip)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		logger("client: "+client+" "+err.Error(), "err")
-	} else {
-		w.WriteHeader(200)
-		w.Write([]byte("OK\n"))
-		logger("client: "+client+" successfully updated DigitalOcean DNS hostname: "+hostname+" ip: "+ip, "info")
+	// DigitalOcean DNS API is straightforward like Cloudflare, the client is reused across requests
+	client, _ := cached(cacheKey("digitalocean", settings["token"]), clientCacheTTL, func() (*godo.Client, error) {
+		return godo.NewFromToken(settings["token"]), nil
+	})
+	values := managedValues(update, multi)
+	for _, recType := range []string{"A", "AAAA"} {
+		if len(values[recType]) == 0 {
+			continue
+		}
+		err := doDoUpdate(ctx, client, settings["domain"], update.hostname, recType, values[recType], update.ttl, multi)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
 }
 
-func doDoUpdate(domainName, apiToken, hostname, ip string) error {
-	client := godo.NewFromToken(apiToken)
-
-	// Extract domain from hostname if not provided separately
+func doDoUpdate(ctx context.Context, client *godo.Client, domainName, hostname, recType string, ips []string, ttl int, multi bool) error {
 	// For DO, we expect the domain name to be passed as username
 	domain := domainName
 
-	// Get the record name (subdomain part)
-	recordName := hostname
-	if strings.Contains(hostname, domain) {
-		// Remove the domain part to get just the record name
-		recordName = strings.TrimSuffix(hostname, "."+domain)
-		if recordName == domain {
-			recordName = "@" // root domain
-		}
-	}
-
-	// Check if DNS Record exists
-	records, _, err := client.Domains.Records(context.Background(), domain, nil)
+	// Get the record name (subdomain part), DO names the zone apex @
+	recordName, err := subdomainOf(hostname, domain)
 	if err != nil {
-		return errors.New("failed to list DNS records or domain not found")
+		return err
+	}
+	if recordName == "" {
+		recordName = "@"
 	}
 
-	var existingRecord *godo.DomainRecord
-	for _, record := range records {
-		if record.Name == recordName && record.Type == "A" {
-			existingRecord = &record
+	// Check which DNS Records exist, the api filters by the full name and type and every page is
+	// read so a record is never missed in a large domain
+	var matching []godo.DomainRecord
+	var existing []string
+	opt := &godo.ListOptions{PerPage: 200}
+	for {
+		records, resp, err := client.Domains.RecordsByTypeAndName(ctx, domain, recType, hostname, opt)
+		if err != nil {
+			return fmt.Errorf("failed to list DNS records or domain not found: %w", err)
+		}
+		for _, record := range records {
+			matching = append(matching, record)
+			existing = append(existing, record.Data)
+		}
+		if resp.Links == nil || resp.Links.IsLastPage() {
 			break
 		}
+		page, err := resp.Links.CurrentPage()
+		if err != nil {
+			return fmt.Errorf("failed to read DNS record pages: %w", err)
+		}
+		opt.Page = page + 1
 	}
 
-	if existingRecord != nil {
-		// Update existing record
+	// records are updated and created before the extras are deleted so the name always resolves
+	plan := planRecords(existing, ips, multi)
+	for _, change := range plan.update {
 		editRequest := &godo.DomainRecordEditRequest{
-			Type: "A",
+			Type: recType,
 			Name: recordName,
-			Data: ip,
-			TTL:  300,
+			Data: change.value,
+			TTL:  ttl,
 		}
-		_, _, err = client.Domains.EditRecord(context.Background(), domain, existingRecord.ID, editRequest)
+		_, _, err = client.Domains.EditRecord(ctx, domain, matching[change.index].ID, editRequest)
 		if err != nil {
 			return err
 		}
-	} else {
-		// Create new record
+	}
+	for _, ip := range plan.create {
 		createRequest := &godo.DomainRecordEditRequest{
-			Type: "A",
+			Type: recType,
 			Name: recordName,
 			Data: ip,
-			TTL:  300,
+			TTL:  ttl,
 		}
-		_, _, err = client.Domains.CreateRecord(context.Background(), domain, createRequest)
+		_, _, err = client.Domains.CreateRecord(ctx, domain, createRequest)
 		if err != nil {
 			return err
 		}
 	}
+	for _, index := range plan.remove {
+		_, err = client.Domains.DeleteRecord(ctx, domain, matching[index].ID)
+		if err != nil {
+			return fmt.Errorf("failed to delete duplicate record: %w", err)
+		}
+	}
 
 	return nil
 }
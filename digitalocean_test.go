@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/digitalocean/godo"
+)
+
+func TestDigitalOceanConverge(t *testing.T) {
+	tests := []struct {
+		name     string
+		ips      []string
+		multi    bool
+		want     []string
+		wantBody map[string]string
+	}{
+		{"duplicate and stale records", []string{"192.0.2.1", "192.0.2.2"}, false,
+			[]string{"GET /v2/domains/example.com/records", "PUT /v2/domains/example.com/records/1", "PUT /v2/domains/example.com/records/2", "DELETE /v2/domains/example.com/records/3"},
+			map[string]string{"1": "192.0.2.1", "2": "192.0.2.2"}},
+		{"multi leaves the extras alone", []string{"192.0.2.2"}, true,
+			[]string{"GET /v2/domains/example.com/records", "PUT /v2/domains/example.com/records/1"},
+			map[string]string{"1": "192.0.2.2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var endpoint string
+			mock := startMockAPI(t, &endpoint, func(w http.ResponseWriter, call apiCall) {
+				w.Header().Set("Content-Type", "application/json")
+				switch call.method {
+				case "GET":
+					w.Write([]byte(`{"domain_records":[
+						{"id":1,"type":"A","name":"home","data":"192.0.2.1"},
+						{"id":2,"type":"A","name":"home","data":"192.0.2.9"},
+						{"id":3,"type":"A","name":"home","data":"192.0.2.1"}],
+						"links":{},"meta":{"total":3}}`))
+				case "DELETE":
+					w.WriteHeader(http.StatusNoContent)
+				default:
+					w.Write([]byte(`{"domain_record":{"id":1}}`))
+				}
+			})
+			client, err := godo.New(http.DefaultClient, godo.SetBaseURL(endpoint+"/"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			err = doDoUpdate(t.Context(), client, "example.com", "home.example.com", "A", test.ips, 300, test.multi)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := mock.requests(); !slices.Equal(got, test.want) {
+				t.Errorf("requests = %v, want %v", got, test.want)
+			}
+			for _, call := range mock.received() {
+				if call.method != "PUT" {
+					continue
+				}
+				var record godo.DomainRecordEditRequest
+				json.Unmarshal([]byte(call.body), &record)
+				id := call.path[strings.LastIndex(call.path, "/")+1:]
+				if record.Data != test.wantBody[id] || record.Name != "home" {
+					t.Errorf("record %s = %s %s, want home %s", id, record.Name, record.Data, test.wantBody[id])
+				}
+			}
+		})
+	}
+}
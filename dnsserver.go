@@ -0,0 +1,312 @@
+package main
+
+// The embedded dns server answers for a delegated subzone itself, so updates take effect the moment
+// they're made with no provider api in between. Delegate dyn.example.com to the host running
+// cloud-ddns with NS records in the parent zone and point routers at /dnsserver/.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	defaultDNSListen    = ":53"
+	defaultDNSStateFile = "/var/lib/cloud-ddns/dnsserver.json"
+	// ttl used for the SOA and NS records and for negative answers
+	defaultDNSZoneTTL = 300
+)
+
+// DNSServerConfig is the "dnsServer" section of the config, the server only starts when it's set
+type DNSServerConfig struct {
+	// Listen is the address to answer on over both udp and tcp, defaults to :53
+	Listen string `json:"listen"`
+	Zone   string `json:"zone"`
+	// Nameservers are the names the parent zone delegates to, they're served as the zone's NS records
+	Nameservers []string `json:"nameservers"`
+	// Hostmaster is the SOA contact as a dns name, defaults to hostmaster.<zone>
+	Hostmaster string `json:"hostmaster"`
+	// TTL is used for the SOA and NS records and for negative answers
+	TTL int `json:"ttl"`
+	// StateFile keeps the records across restarts, defaults to /var/lib/cloud-ddns/dnsserver.json
+	StateFile string `json:"stateFile"`
+}
+
+// dnsServerState is what the state file holds, the serial goes up on every change
+type dnsServerState struct {
+	Serial  uint32                    `json:"serial"`
+	Records map[string]*dnsServerHost `json:"records"`
+}
+
+// dnsServerHost is the latest update for a hostname
+type dnsServerHost struct {
+	A       []string  `json:"a,omitempty"`
+	AAAA    []string  `json:"aaaa,omitempty"`
+	TTL     int       `json:"ttl"`
+	Updated time.Time `json:"updated"`
+}
+
+var dnsState = struct {
+	sync.RWMutex
+	dnsServerState
+}{}
+
+// compile checks the zone and nameservers are set and fills in the defaults
+func (c *DNSServerConfig) compile() error {
+	if c.Zone == "" {
+		return errors.New("dns server has no zone")
+	}
+	if len(c.Nameservers) == 0 {
+		return errors.New("dns server has no nameservers")
+	}
+	c.Zone = dns.CanonicalName(c.Zone)
+	for i, ns := range c.Nameservers {
+		c.Nameservers[i] = dns.CanonicalName(ns)
+	}
+	if c.Hostmaster == "" {
+		c.Hostmaster = "hostmaster." + c.Zone
+	}
+	c.Hostmaster = dns.CanonicalName(c.Hostmaster)
+	if c.Listen == "" {
+		c.Listen = defaultDNSListen
+	}
+	if c.TTL == 0 {
+		c.TTL = defaultDNSZoneTTL
+	}
+	if c.StateFile == "" {
+		c.StateFile = defaultDNSStateFile
+	}
+	return nil
+}
+
+// startDNSServer loads the saved records and starts answering queries, the sockets are opened here
+// so a port that's already taken stops cloud-ddns from starting rather than failing quietly
+func startDNSServer(c *DNSServerConfig) error {
+	err := loadDNSState(c.StateFile)
+	if err != nil {
+		return err
+	}
+	packetConn, err := net.ListenPacket("udp", c.Listen)
+	if err != nil {
+		return err
+	}
+	listener, err := net.Listen("tcp", c.Listen)
+	if err != nil {
+		packetConn.Close()
+		return err
+	}
+
+	handler := dnsHandler(c)
+	for _, server := range []*dns.Server{
+		{PacketConn: packetConn, Handler: handler},
+		{Listener: listener, Handler: handler},
+	} {
+		go func(server *dns.Server) {
+			err := server.ActivateAndServe()
+			if err != nil {
+				logger("dns server stopped: "+err.Error(), "err")
+			}
+		}(server)
+	}
+	logger("dns server answering for "+c.Zone+" on "+c.Listen, "info")
+	return nil
+}
+
+// dnsHandler answers queries for the zone, truncating udp answers that don't fit
+func dnsHandler(c *DNSServerConfig) dns.Handler {
+	return dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		w.WriteMsg(dnsAnswer(c, r, w.LocalAddr().Network() == "udp"))
+	})
+}
+
+func loadDNSState(path string) error {
+	dnsState.Lock()
+	defer dnsState.Unlock()
+	dnsState.Records = make(map[string]*dnsServerHost)
+	data, err := os.ReadFile(path)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	err = json.Unmarshal(data, &dnsState.dnsServerState)
+	if err != nil {
+		return errors.New("failed to parse " + path + ": " + err.Error())
+	}
+	if dnsState.Records == nil {
+		dnsState.Records = make(map[string]*dnsServerHost)
+	}
+	return nil
+}
+
+// saveDNSState writes the state with writeFileAtomic so a crash never leaves half a file behind,
+// it's called with the lock held
+func saveDNSState(path string, state *dnsServerState) error {
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0755)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+func dnsServerUpdate(ctx context.Context, settings map[string]string, update *dnsUpdate) error {
+	c := config.DNSServer
+	if c == nil {
+		return errors.New("dns server is not configured")
+	}
+	if settings["zone"] != "" {
+		_, err := subdomainOf(update.hostname, settings["zone"])
+		if err != nil {
+			return err
+		}
+	}
+	name := dns.CanonicalName(update.hostname)
+	if _, ok := dns.IsDomainName(name); !ok || !dns.IsSubDomain(c.Zone, name) {
+		return newDyndnsError(dyndnsNoHost, "hostname does not match zone")
+	}
+
+	dnsState.Lock()
+	defer dnsState.Unlock()
+
+	// record types missing from the request are left as they are
+	host := &dnsServerHost{TTL: update.ttl, Updated: time.Now().UTC()}
+	if old, found := dnsState.Records[name]; found {
+		host.A, host.AAAA = old.A, old.AAAA
+	}
+	byType := ipsByType(update.ips)
+	if len(byType["A"]) > 0 {
+		host.A = byType["A"]
+	}
+	if len(byType["AAAA"]) > 0 {
+		host.AAAA = byType["AAAA"]
+	}
+	if old, found := dnsState.Records[name]; found && old.TTL == host.TTL &&
+		sameValues(old.A, host.A) && sameValues(old.AAAA, host.AAAA) {
+		return errNoChange
+	}
+
+	state := dnsServerState{Serial: dnsState.Serial + 1, Records: make(map[string]*dnsServerHost)}
+	for key, value := range dnsState.Records {
+		state.Records[key] = value
+	}
+	state.Records[name] = host
+	err := saveDNSState(c.StateFile, &state)
+	if err != nil {
+		return errors.New("failed to save dns server state: " + err.Error())
+	}
+	dnsState.dnsServerState = state
+	return nil
+}
+
+// sameValues compares two lists of addresses ignoring order
+func sameValues(a, b []string) bool {
+	a, b = slices.Clone(a), slices.Clone(b)
+	slices.Sort(a)
+	slices.Sort(b)
+	return slices.Equal(a, b)
+}
+
+// dnsAnswer builds the reply to a query, names outside the zone are refused since this is only an
+// authoritative server and never a resolver
+func dnsAnswer(c *DNSServerConfig, r *dns.Msg, udp bool) *dns.Msg {
+	m := new(dns.Msg)
+	if r.Opcode != dns.OpcodeQuery || len(r.Question) != 1 {
+		return m.SetRcode(r, dns.RcodeNotImplemented)
+	}
+	m.SetReply(r)
+	q := r.Question[0]
+	name := dns.CanonicalName(q.Name)
+	if q.Qclass != dns.ClassINET || !dns.IsSubDomain(c.Zone, name) {
+		m.Rcode = dns.RcodeRefused
+		return m
+	}
+	m.Authoritative = true
+
+	dnsState.RLock()
+	soa := &dns.SOA{
+		Hdr:     dns.RR_Header{Name: c.Zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: uint32(c.TTL)},
+		Ns:      c.Nameservers[0],
+		Mbox:    c.Hostmaster,
+		Serial:  dnsState.Serial,
+		Refresh: 3600,
+		Retry:   600,
+		Expire:  604800,
+		Minttl:  uint32(c.TTL),
+	}
+	host := dnsState.Records[name]
+	exists := host != nil || name == c.Zone
+	if !exists {
+		// a name with records below it exists even with none of its own
+		for key := range dnsState.Records {
+			if dns.IsSubDomain(name, key) {
+				exists = true
+				break
+			}
+		}
+	}
+	if name == c.Zone {
+		if q.Qtype == dns.TypeSOA || q.Qtype == dns.TypeANY {
+			m.Answer = append(m.Answer, soa)
+		}
+		if q.Qtype == dns.TypeNS || q.Qtype == dns.TypeANY {
+			for _, ns := range c.Nameservers {
+				m.Answer = append(m.Answer, &dns.NS{Hdr: dns.RR_Header{Name: c.Zone, Rrtype: dns.TypeNS, Class: dns.ClassINET, Ttl: uint32(c.TTL)}, Ns: ns})
+				// glue for nameservers inside the zone
+				m.Extra = append(m.Extra, dnsHostRecords(ns, dnsState.Records[ns], dns.TypeANY)...)
+			}
+		}
+	}
+	m.Answer = append(m.Answer, dnsHostRecords(name, host, q.Qtype)...)
+	dnsState.RUnlock()
+
+	if !exists {
+		m.Rcode = dns.RcodeNameError
+	}
+	if len(m.Answer) == 0 {
+		m.Ns = append(m.Ns, soa)
+	}
+
+	size := dns.MinMsgSize
+	if opt := r.IsEdns0(); opt != nil {
+		size = max(int(opt.UDPSize()), dns.MinMsgSize)
+		m.SetEdns0(uint16(size), false)
+	}
+	if udp {
+		m.Truncate(size)
+	}
+	return m
+}
+
+// dnsHostRecords returns a host's records of qtype, or all of them for ANY
+func dnsHostRecords(name string, host *dnsServerHost, qtype uint16) []dns.RR {
+	if host == nil {
+		return nil
+	}
+	var records []dns.RR
+	hdr := dns.RR_Header{Name: name, Class: dns.ClassINET, Ttl: uint32(host.TTL)}
+	if qtype == dns.TypeA || qtype == dns.TypeANY {
+		for _, ip := range host.A {
+			hdr.Rrtype = dns.TypeA
+			records = append(records, &dns.A{Hdr: hdr, A: net.ParseIP(ip)})
+		}
+	}
+	if qtype == dns.TypeAAAA || qtype == dns.TypeANY {
+		for _, ip := range host.AAAA {
+			hdr.Rrtype = dns.TypeAAAA
+			records = append(records, &dns.AAAA{Hdr: hdr, AAAA: net.ParseIP(ip)})
+		}
+	}
+	return records
+}
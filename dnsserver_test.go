@@ -0,0 +1,242 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// testDNSServer serves the zone dyn.example.com on 127.0.0.1 over udp and tcp for the rest of the
+// test, with empty state kept in a temp dir, it returns the udp and tcp addresses
+func testDNSServer(t *testing.T) (*DNSServerConfig, string, string) {
+	t.Helper()
+	c := &DNSServerConfig{
+		Zone:        "dyn.example.com",
+		Nameservers: []string{"ns1.dyn.example.com", "ns.example.net"},
+		StateFile:   filepath.Join(t.TempDir(), "dnsserver.json"),
+	}
+	err := c.compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = loadDNSState(c.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := config
+	config = &Config{DNSServer: c}
+
+	packetConn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var servers []*dns.Server
+	for _, server := range []*dns.Server{
+		{PacketConn: packetConn, Handler: dnsHandler(c)},
+		{Listener: listener, Handler: dnsHandler(c)},
+	} {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go server.ActivateAndServe()
+		<-started
+		servers = append(servers, server)
+	}
+	t.Cleanup(func() {
+		for _, server := range servers {
+			server.Shutdown()
+		}
+		config = saved
+		dnsState.Lock()
+		dnsState.dnsServerState = dnsServerState{}
+		dnsState.Unlock()
+	})
+	return c, packetConn.LocalAddr().String(), listener.Addr().String()
+}
+
+// dnsSet applies an update through the provider the same way a client request would
+func dnsSet(t *testing.T, hostname string, ips ...string) {
+	t.Helper()
+	err := dnsServerUpdate(t.Context(), map[string]string{}, &dnsUpdate{hostname: hostname, ips: ips, ttl: 60})
+	if err != nil {
+		t.Fatalf("update %s: %v", hostname, err)
+	}
+}
+
+// dnsQuery asks addr over network, with an edns0 buffer size when bufsize isn't zero
+func dnsQuery(t *testing.T, network, addr, name string, qtype uint16, bufsize uint16) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	if bufsize > 0 {
+		m.SetEdns0(bufsize, false)
+	}
+	client := &dns.Client{Net: network, UDPSize: bufsize}
+	reply, _, err := client.Exchange(m, addr)
+	if err != nil {
+		t.Fatalf("query %s %s: %v", name, dns.TypeToString[qtype], err)
+	}
+	return reply
+}
+
+// rrStrings returns records as strings for comparing
+func rrStrings(records []dns.RR) []string {
+	var strings []string
+	for _, rr := range records {
+		strings = append(strings, rr.String())
+	}
+	return strings
+}
+
+func TestDNSServerAnswers(t *testing.T) {
+	_, udp, _ := testDNSServer(t)
+	dnsSet(t, "home.dyn.example.com", "192.0.2.1", "2001:db8::1")
+	dnsSet(t, "v4only.dyn.example.com", "192.0.2.2")
+	dnsSet(t, "a.b.dyn.example.com", "192.0.2.3")
+	dnsSet(t, "ns1.dyn.example.com", "192.0.2.53")
+
+	tests := []struct {
+		name      string
+		qname     string
+		qtype     uint16
+		rcode     int
+		answers   int
+		soaInAuth bool
+	}{
+		{"name outside the zone is refused", "home.example.org", dns.TypeA, dns.RcodeRefused, 0, false},
+		{"parent of the zone is refused", "example.com", dns.TypeSOA, dns.RcodeRefused, 0, false},
+		{"host answers", "home.dyn.example.com", dns.TypeA, dns.RcodeSuccess, 1, false},
+		{"names are case insensitive", "HOME.Dyn.Example.COM", dns.TypeAAAA, dns.RcodeSuccess, 1, false},
+		{"any returns both types", "home.dyn.example.com", dns.TypeANY, dns.RcodeSuccess, 2, false},
+		{"missing name is nxdomain", "nothere.dyn.example.com", dns.TypeA, dns.RcodeNameError, 0, true},
+		{"missing type is nodata", "v4only.dyn.example.com", dns.TypeAAAA, dns.RcodeSuccess, 0, true},
+		{"type never served is nodata", "home.dyn.example.com", dns.TypeTXT, dns.RcodeSuccess, 0, true},
+		{"empty non-terminal is nodata", "b.dyn.example.com", dns.TypeA, dns.RcodeSuccess, 0, true},
+		{"below a host is nxdomain", "x.home.dyn.example.com", dns.TypeA, dns.RcodeNameError, 0, true},
+		{"apex soa", "dyn.example.com", dns.TypeSOA, dns.RcodeSuccess, 1, false},
+		{"apex without addresses is nodata", "dyn.example.com", dns.TypeA, dns.RcodeSuccess, 0, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reply := dnsQuery(t, "udp", udp, test.qname, test.qtype, 0)
+			if reply.Rcode != test.rcode {
+				t.Errorf("rcode = %s, want %s", dns.RcodeToString[reply.Rcode], dns.RcodeToString[test.rcode])
+			}
+			if len(reply.Answer) != test.answers {
+				t.Errorf("answers = %v, want %d", rrStrings(reply.Answer), test.answers)
+			}
+			if test.rcode == dns.RcodeRefused {
+				if reply.Authoritative || len(reply.Ns) > 0 {
+					t.Error("refused answer is authoritative or has an authority section")
+				}
+				return
+			}
+			if !reply.Authoritative {
+				t.Error("answer is not authoritative")
+			}
+			hasSOA := len(reply.Ns) == 1 && reply.Ns[0].Header().Rrtype == dns.TypeSOA && reply.Ns[0].Header().Name == "dyn.example.com."
+			if hasSOA != test.soaInAuth {
+				t.Errorf("authority = %v, want soa %v", rrStrings(reply.Ns), test.soaInAuth)
+			}
+		})
+	}
+}
+
+func TestDNSServerGlue(t *testing.T) {
+	_, udp, _ := testDNSServer(t)
+	dnsSet(t, "ns1.dyn.example.com", "192.0.2.53", "2001:db8::53")
+
+	reply := dnsQuery(t, "udp", udp, "dyn.example.com", dns.TypeNS, 0)
+	want := []string{
+		"dyn.example.com.\t300\tIN\tNS\tns1.dyn.example.com.",
+		"dyn.example.com.\t300\tIN\tNS\tns.example.net.",
+	}
+	if got := rrStrings(reply.Answer); !slices.Equal(got, want) {
+		t.Errorf("answer = %v, want %v", got, want)
+	}
+	// only the nameserver inside the zone gets glue, the other one is someone else's
+	wantGlue := []string{
+		"ns1.dyn.example.com.\t60\tIN\tA\t192.0.2.53",
+		"ns1.dyn.example.com.\t60\tIN\tAAAA\t2001:db8::53",
+	}
+	if got := rrStrings(reply.Extra); !slices.Equal(got, wantGlue) {
+		t.Errorf("additional = %v, want %v", got, wantGlue)
+	}
+}
+
+func TestDNSServerTruncation(t *testing.T) {
+	_, udp, tcp := testDNSServer(t)
+	var ips []string
+	for i := 1; i <= 40; i++ {
+		ips = append(ips, "2001:db8::"+strconv.Itoa(i))
+	}
+	dnsSet(t, "many.dyn.example.com", ips...)
+
+	tests := []struct {
+		name      string
+		network   string
+		addr      string
+		bufsize   uint16
+		truncated bool
+	}{
+		{"udp without edns is truncated to 512 bytes", "udp", udp, 0, true},
+		{"udp with a large edns buffer fits", "udp", udp, 4096, false},
+		{"tcp is never truncated", "tcp", tcp, 0, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			reply := dnsQuery(t, test.network, test.addr, "many.dyn.example.com", dns.TypeAAAA, test.bufsize)
+			if reply.Truncated != test.truncated {
+				t.Errorf("truncated = %v, want %v", reply.Truncated, test.truncated)
+			}
+			if !test.truncated && len(reply.Answer) != len(ips) {
+				t.Errorf("answers = %d, want %d", len(reply.Answer), len(ips))
+			}
+			reply.Compress = true
+			if packed, _ := reply.Pack(); test.network == "udp" && test.bufsize == 0 && len(packed) > dns.MinMsgSize {
+				t.Errorf("udp answer is %d bytes, more than %d", len(packed), dns.MinMsgSize)
+			}
+		})
+	}
+}
+
+func TestDNSServerStateSurvivesReload(t *testing.T) {
+	c, udp, _ := testDNSServer(t)
+	dnsSet(t, "home.dyn.example.com", "192.0.2.1")
+	dnsSet(t, "home.dyn.example.com", "192.0.2.2", "2001:db8::2")
+	before := dnsQuery(t, "udp", udp, "home.dyn.example.com", dns.TypeANY, 0)
+	serial := dnsQuery(t, "udp", udp, "dyn.example.com", dns.TypeSOA, 0).Answer[0].(*dns.SOA).Serial
+	if serial != 2 {
+		t.Errorf("serial = %d after two changes, want 2", serial)
+	}
+
+	// forget everything in memory then read it back from the state file as a restart would
+	dnsState.Lock()
+	dnsState.dnsServerState = dnsServerState{}
+	dnsState.Unlock()
+	err := loadDNSState(c.StateFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	after := dnsQuery(t, "udp", udp, "home.dyn.example.com", dns.TypeANY, 0)
+	if !slices.Equal(rrStrings(after.Answer), rrStrings(before.Answer)) || len(after.Answer) != 2 {
+		t.Errorf("after reload answer = %v, want %v", rrStrings(after.Answer), rrStrings(before.Answer))
+	}
+	if got := dnsQuery(t, "udp", udp, "dyn.example.com", dns.TypeSOA, 0).Answer[0].(*dns.SOA).Serial; got != serial {
+		t.Errorf("serial after reload = %d, want %d", got, serial)
+	}
+
+	// an update that matches the reloaded state is still recognised as no change
+	err = dnsServerUpdate(t.Context(), map[string]string{}, &dnsUpdate{hostname: "home.dyn.example.com", ips: []string{"2001:db8::2", "192.0.2.2"}, ttl: 60})
+	if err != errNoChange {
+		t.Errorf("err = %v, want nochg", err)
+	}
+}
@@ -0,0 +1,107 @@
+package main
+
+// This file contains the dyndns return codes, every response body starts with one so routers and
+// ddclient style clients can tell a bad login apart from a provider outage
+
+import (
+	"errors"
+	"net/http"
+	"strings"
+)
+
+const (
+	dyndnsGood    = "good"
+	dyndnsNoChg   = "nochg"
+	dyndnsBadAuth = "badauth"
+	// badagent is used for malformed requests, clients treat it as needing a config fix rather than a retry
+	dyndnsBadAgent = "badagent"
+	dyndnsNotFQDN  = "notfqdn"
+	dyndnsNoHost   = "nohost"
+	dyndnsAbuse    = "abuse"
+	dyndnsDNSErr   = "dnserr"
+	dyndns911      = "911"
+)
+
+// dyndnsError is an error that should be reported with a particular return code, errors without
+// one are provider failures and reported as dnserr
+type dyndnsError struct {
+	code string
+	err  error
+}
+
+func (e *dyndnsError) Error() string {
+	return e.err.Error()
+}
+
+func (e *dyndnsError) Unwrap() error {
+	return e.err
+}
+
+func newDyndnsError(code, message string) error {
+	return &dyndnsError{code: code, err: errors.New(message)}
+}
+
+// errNoChange is returned by a provider that found the record already up to date, it's reported
+// to the client as nochg rather than a failure
+var errNoChange = errors.New("record already up to date")
+
+// errPending is returned by a provider that stopped waiting for an accepted change to reach every
+// name server, it's reported as good followed by the message so the client can tell
+var errPending = errors.New("change accepted but not yet in sync")
+
+// applied reports whether err means the update went through, whether or not it changed anything
+func applied(err error) bool {
+	return err == nil || errors.Is(err, errNoChange) || errors.Is(err, errPending)
+}
+
+func dyndnsCode(err error) string {
+	if err == nil || errors.Is(err, errPending) {
+		return dyndnsGood
+	}
+	if errors.Is(err, errNoChange) {
+		return dyndnsNoChg
+	}
+	var dyndnsErr *dyndnsError
+	if errors.As(err, &dyndnsErr) {
+		return dyndnsErr.code
+	}
+	return dyndnsDNSErr
+}
+
+// dyndnsStatus is the http status code sent along with a return code
+func dyndnsStatus(code string) int {
+	switch code {
+	case dyndnsGood, dyndnsNoChg:
+		return http.StatusOK
+	case dyndnsBadAuth:
+		return http.StatusUnauthorized
+	case dyndnsBadAgent, dyndnsNotFQDN, dyndnsNoHost:
+		return http.StatusBadRequest
+	case dyndnsAbuse:
+		return http.StatusTooManyRequests
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// respond writes the result of an update, "good 1.2.3.4" on success or the return code followed
+// by the error message on failure, a pending change has its message after the ips
+func respond(w http.ResponseWriter, ips []string, err error) {
+	code := dyndnsCode(err)
+	if code == dyndnsGood || code == dyndnsNoChg {
+		w.WriteHeader(dyndnsStatus(code))
+		w.Write([]byte(resultLine(code, ips, err) + "\n"))
+		return
+	}
+	http.Error(w, code+" "+err.Error(), dyndnsStatus(code))
+}
+
+// resultLine is the first line of a successful response, "good 1.2.3.4" or for a change that's
+// still pending "good 1.2.3.4 change accepted but not yet in sync"
+func resultLine(code string, ips []string, err error) string {
+	line := code + " " + strings.Join(ips, ",")
+	if errors.Is(err, errPending) {
+		line += " " + err.Error()
+	}
+	return line
+}
@@ -0,0 +1,222 @@
+package main
+
+// The exec provider runs an external program for each update, so providers that can't live in this
+// repo can be written in shell or python. The program gets a json document on stdin and can answer
+// with a json result on stdout, its exit code maps onto the dyndns return codes:
+//
+//	0 good, 1 dnserr, 2 badauth, 3 nohost, 4 notfqdn, 5 abuse, anything else 911
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how long a program may run when its config doesn't say
+const execDefaultTimeout = 30 * time.Second
+
+// stderr beyond this is dropped rather than filling the logs
+const execMaxStderr = 64 * 1024
+
+// ExecProvider is an external program from the "exec" section of the config
+type ExecProvider struct {
+	Command string   `json:"command"`
+	Args    []string `json:"args"`
+	// Timeout is a go duration like "30s"
+	Timeout string `json:"timeout"`
+	// Zone lets the program be handed the zone and subdomain, hostnames outside it are refused
+	Zone string `json:"zone"`
+	// Credentials are passed to the program as they are so secrets stay out of its arguments
+	Credentials map[string]string `json:"credentials"`
+
+	timeout time.Duration
+}
+
+// execRequest is the json document written to the program's stdin, one per record type
+type execRequest struct {
+	Action      string            `json:"action"`
+	Hostname    string            `json:"hostname"`
+	Zone        string            `json:"zone"`
+	Subdomain   string            `json:"subdomain"`
+	Type        string            `json:"type"`
+	Values      []string          `json:"values"`
+	TTL         int               `json:"ttl"`
+	Credentials map[string]string `json:"credentials"`
+}
+
+// execResult is the optional json document the program writes to stdout, status is a dyndns return
+// code and overrides the one from the exit code
+type execResult struct {
+	Status  string `json:"status"`
+	Message string `json:"message"`
+}
+
+var execExitCodes = map[int]string{
+	0: dyndnsGood,
+	1: dyndnsDNSErr,
+	2: dyndnsBadAuth,
+	3: dyndnsNoHost,
+	4: dyndnsNotFQDN,
+	5: dyndnsAbuse,
+}
+
+// compile checks there is a command and parses the timeout
+func (e *ExecProvider) compile(name string) error {
+	if e.Command == "" {
+		return errors.New("exec provider " + name + " has no command")
+	}
+	e.timeout = execDefaultTimeout
+	if e.Timeout != "" {
+		timeout, err := time.ParseDuration(e.Timeout)
+		if err != nil || timeout <= 0 {
+			return errors.New("exec provider " + name + " has an invalid timeout")
+		}
+		e.timeout = timeout
+	}
+	return nil
+}
+
+func execUpdate(ctx context.Context, settings map[string]string, update *dnsUpdate) error {
+	name := settings["name"]
+	e, found := config.Exec[name]
+	if !found {
+		return errors.New("exec provider " + name + " not found in config")
+	}
+
+	zone := e.Zone
+	if settings["zone"] != "" {
+		zone = settings["zone"]
+	}
+	var subdomain string
+	if zone != "" {
+		var err error
+		subdomain, err = subdomainOf(update.hostname, zone)
+		if err != nil {
+			return err
+		}
+	}
+
+	// nochg only when no record type changed
+	var changed bool
+	byType := ipsByType(update.ips)
+	for _, fieldType := range []string{"A", "AAAA"} {
+		if len(byType[fieldType]) == 0 {
+			continue
+		}
+		err := e.run(ctx, name, execRequest{
+			Action:      "update",
+			Hostname:    update.hostname,
+			Zone:        zone,
+			Subdomain:   subdomain,
+			Type:        fieldType,
+			Values:      byType[fieldType],
+			TTL:         update.ttl,
+			Credentials: e.Credentials,
+		})
+		if err == nil {
+			changed = true
+		} else if !errors.Is(err, errNoChange) {
+			return err
+		}
+	}
+	if !changed {
+		return errNoChange
+	}
+	return nil
+}
+
+func (e *ExecProvider) run(ctx context.Context, name string, request execRequest) error {
+	input, err := json.Marshal(request)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, e.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, e.Command, e.Args...)
+	cmd.Stdin = bytes.NewReader(input)
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &limitedWriter{buf: &stderr, limit: execMaxStderr}
+	cmd.WaitDelay = time.Second
+	err = cmd.Run()
+
+	// anything the program wrote to stderr goes into the logs a line at a time
+	scanner := bufio.NewScanner(&stderr)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" {
+			logger("exec "+name+": "+line, "notice")
+		}
+	}
+
+	if ctx.Err() == context.DeadlineExceeded {
+		return newDyndnsError(dyndns911, "exec provider "+name+" timed out after "+e.timeout.String())
+	}
+
+	exitCode := 0
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) {
+		exitCode = exitErr.ExitCode()
+	} else if err != nil {
+		return newDyndnsError(dyndns911, "exec provider "+name+" failed to run: "+err.Error())
+	}
+
+	code, found := execExitCodes[exitCode]
+	if !found {
+		code = dyndns911
+	}
+	message := "exec provider " + name + " exited with " + strconv.Itoa(exitCode)
+
+	var result execResult
+	if output := bytes.TrimSpace(stdout.Bytes()); len(output) > 0 {
+		err = json.Unmarshal(output, &result)
+		if err != nil {
+			return newDyndnsError(dyndns911, "exec provider "+name+" wrote invalid json: "+err.Error())
+		}
+		switch result.Status {
+		case dyndnsGood, dyndnsNoChg, dyndnsBadAuth, dyndnsNotFQDN, dyndnsNoHost, dyndnsAbuse, dyndnsDNSErr, dyndns911:
+			code = result.Status
+		}
+		if result.Message != "" {
+			message = "exec provider " + name + ": " + result.Message
+		}
+	}
+
+	switch code {
+	case dyndnsGood:
+		if exitCode != 0 {
+			return newDyndnsError(dyndns911, message)
+		}
+		return nil
+	case dyndnsNoChg:
+		if exitCode != 0 {
+			return newDyndnsError(dyndns911, message)
+		}
+		return errNoChange
+	default:
+		return newDyndnsError(code, message)
+	}
+}
+
+// limitedWriter keeps the first limit bytes written to it and quietly drops the rest
+type limitedWriter struct {
+	buf   *bytes.Buffer
+	limit int
+}
+
+func (l *limitedWriter) Write(p []byte) (int, error) {
+	if room := l.limit - l.buf.Len(); room > 0 {
+		if len(p) > room {
+			l.buf.Write(p[:room])
+		} else {
+			l.buf.Write(p)
+		}
+	}
+	return len(p), nil
+}
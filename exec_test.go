@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testExec configures the exec provider "script" to run script with sh for the rest of the test
+func testExec(t *testing.T, script, timeout string) {
+	t.Helper()
+	e := &ExecProvider{
+		Command:     "/bin/sh",
+		Args:        []string{"-c", script},
+		Timeout:     timeout,
+		Zone:        "example.com",
+		Credentials: map[string]string{"token": "secret"},
+	}
+	err := e.compile("script")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := config
+	config = &Config{Exec: map[string]*ExecProvider{"script": e}}
+	t.Cleanup(func() { config = saved })
+}
+
+func TestExecUpdateRequest(t *testing.T) {
+	requests := filepath.Join(t.TempDir(), "requests")
+	testExec(t, `cat >> `+requests+`; echo >> `+requests, "")
+
+	update := &dnsUpdate{hostname: "home.example.com", ips: []string{"192.0.2.1", "2001:db8::1", "192.0.2.2"}, ttl: 120}
+	err := execUpdate(t.Context(), map[string]string{"name": "script"}, update)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+
+	// one request per record type, each on the program's stdin
+	data, err := os.ReadFile(requests)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []execRequest
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		var request execRequest
+		err = json.Unmarshal([]byte(line), &request)
+		if err != nil {
+			t.Fatalf("stdin %q: %v", line, err)
+		}
+		got = append(got, request)
+	}
+	want := []execRequest{
+		{Action: "update", Hostname: "home.example.com", Zone: "example.com", Subdomain: "home", Type: "A",
+			Values: []string{"192.0.2.1", "192.0.2.2"}, TTL: 120, Credentials: map[string]string{"token": "secret"}},
+		{Action: "update", Hostname: "home.example.com", Zone: "example.com", Subdomain: "home", Type: "AAAA",
+			Values: []string{"2001:db8::1"}, TTL: 120, Credentials: map[string]string{"token": "secret"}},
+	}
+	if len(got) != len(want) {
+		t.Fatalf("requests = %+v, want %+v", got, want)
+	}
+	for i := range want {
+		if got[i].Action != want[i].Action || got[i].Hostname != want[i].Hostname || got[i].Zone != want[i].Zone ||
+			got[i].Subdomain != want[i].Subdomain || got[i].Type != want[i].Type || !slices.Equal(got[i].Values, want[i].Values) ||
+			got[i].TTL != want[i].TTL || got[i].Credentials["token"] != "secret" {
+			t.Errorf("request %d = %+v, want %+v", i, got[i], want[i])
+		}
+	}
+
+	// a client held to a subzone never gets as far as running the program
+	err = execUpdate(t.Context(), map[string]string{"name": "script", "zone": "dyn.example.com"}, update)
+	if dyndnsCode(err) != dyndnsNoHost {
+		t.Errorf("err = %v, want nohost", err)
+	}
+	if again, _ := os.ReadFile(requests); !bytes.Equal(again, data) {
+		t.Error("program ran for a hostname outside the client's zone")
+	}
+}
+
+func TestExecUpdateResult(t *testing.T) {
+	tests := []struct {
+		name        string
+		script      string
+		timeout     string
+		wantCode    string
+		wantMessage string
+	}{
+		{"exit 0 is good", `exit 0`, "", dyndnsGood, ""},
+		{"exit 1 is dnserr", `exit 1`, "", dyndnsDNSErr, "exec provider script exited with 1"},
+		{"exit 2 is badauth", `exit 2`, "", dyndnsBadAuth, "exec provider script exited with 2"},
+		{"exit 3 is nohost", `exit 3`, "", dyndnsNoHost, "exec provider script exited with 3"},
+		{"exit 4 is notfqdn", `exit 4`, "", dyndnsNotFQDN, "exec provider script exited with 4"},
+		{"exit 5 is abuse", `exit 5`, "", dyndnsAbuse, "exec provider script exited with 5"},
+		{"any other exit is 911", `exit 9`, "", dyndns911, "exec provider script exited with 9"},
+		{"stdout nochg", `echo '{"status":"nochg"}'`, "", dyndnsNoChg, ""},
+		{"stdout status overrides the exit code", `echo '{"status":"badauth","message":"token expired"}'; exit 1`, "",
+			dyndnsBadAuth, "exec provider script: token expired"},
+		{"stdout message kept with the exit code", `echo '{"message":"zone is locked"}'; exit 3`, "",
+			dyndnsNoHost, "exec provider script: zone is locked"},
+		{"unknown stdout status leaves the exit code", `echo '{"status":"maybe"}'; exit 2`, "",
+			dyndnsBadAuth, "exec provider script exited with 2"},
+		{"good with a failing exit code is 911", `echo '{"status":"good"}'; exit 1`, "",
+			dyndns911, "exec provider script exited with 1"},
+		{"stdout that isn't json is 911", `echo done`, "", dyndns911, "exec provider script wrote invalid json"},
+		{"timeout is 911", `sleep 10`, "100ms", dyndns911, "exec provider script timed out after 100ms"},
+		{"stderr doesn't change the result", `i=0; while [ $i -lt 2000 ]; do echo "line $i of stderr that goes to the logs" >&2; i=$((i+1)); done`, "",
+			dyndnsGood, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			testExec(t, test.script, test.timeout)
+			start := time.Now()
+			err := execUpdate(t.Context(), map[string]string{"name": "script"}, &dnsUpdate{hostname: "home.example.com", ips: []string{"192.0.2.1"}, ttl: 300})
+			if code := dyndnsCode(err); code != test.wantCode {
+				t.Errorf("code = %s (%v), want %s", code, err, test.wantCode)
+			}
+			if test.wantMessage != "" && (err == nil || !strings.HasPrefix(err.Error(), test.wantMessage)) {
+				t.Errorf("err = %v, want %q", err, test.wantMessage)
+			}
+			if elapsed := time.Since(start); elapsed > 5*time.Second {
+				t.Errorf("took %v", elapsed)
+			}
+		})
+	}
+}
+
+func TestExecUpdateMissingCommand(t *testing.T) {
+	testExec(t, "", "")
+	config.Exec["script"].Command = filepath.Join(t.TempDir(), "missing")
+	err := execUpdate(t.Context(), map[string]string{"name": "script"}, &dnsUpdate{hostname: "home.example.com", ips: []string{"192.0.2.1"}, ttl: 300})
+	if classifyError(err) != errorTransient || !strings.Contains(err.Error(), "failed to run") {
+		t.Errorf("err = %v, want 911 failed to run", err)
+	}
+}
+
+func TestExecUpdateMixedTypes(t *testing.T) {
+	// the A record is already up to date but the AAAA one changes, so the update as a whole is good
+	testExec(t, `if grep -q '"type":"A"'; then echo '{"status":"nochg"}'; fi`, "")
+	err := execUpdate(t.Context(), map[string]string{"name": "script"}, &dnsUpdate{hostname: "home.example.com", ips: []string{"192.0.2.1", "2001:db8::1"}, ttl: 300})
+	if err != nil {
+		t.Errorf("err = %v, want good", err)
+	}
+	testExec(t, `echo '{"status":"nochg"}'`, "")
+	err = execUpdate(t.Context(), map[string]string{"name": "script"}, &dnsUpdate{hostname: "home.example.com", ips: []string{"192.0.2.1", "2001:db8::1"}, ttl: 300})
+	if !errors.Is(err, errNoChange) {
+		t.Errorf("err = %v, want nochg", err)
+	}
+}
+
+func TestLimitedWriter(t *testing.T) {
+	var buf bytes.Buffer
+	w := &limitedWriter{buf: &buf, limit: 10}
+	for _, chunk := range []string{"12345", "67890abc", "def"} {
+		n, err := w.Write([]byte(chunk))
+		if n != len(chunk) || err != nil {
+			t.Errorf("Write(%q) = %d, %v, want %d, nil", chunk, n, err, len(chunk))
+		}
+	}
+	if buf.String() != "1234567890" {
+		t.Errorf("kept %q, want the first 10 bytes", buf.String())
+	}
+}
@@ -0,0 +1,271 @@
+package main
+
+// This file contains the configured hostnames, a hostname in the "hosts" section of the config is
+// updated through /nic/update and mirrored to every target listed for it, so the same record can
+// be kept in route53 and cloudflare from one request
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// every target has to take the update
+	policyAll = "all"
+	// the update is good when at least one target took it
+	policyAny = "any"
+	// targets are tried in order and the next one is only used when the one before it failed
+	// with an error that might be transient
+	policyFailover = "failover"
+)
+
+// Target is a provider with its settings from the "targets" section of the config
+type Target struct {
+	// Provider is the provider name used in the url ie "aws" or "cloudflare"
+	Provider string            `json:"provider"`
+	Settings map[string]string `json:"settings"`
+}
+
+// HostConfig lists the targets a configured hostname is written to, in order
+type HostConfig struct {
+	Targets []string `json:"targets"`
+	// Policy is "all", "any" or "failover", defaults to all
+	Policy string `json:"policy"`
+	// Parallel updates every target at once rather than one after another, failover is always
+	// one after another
+	Parallel bool `json:"parallel"`
+	// Clients are the configured clients allowed to update the hostname
+	Clients []string `json:"clients"`
+	// Settings are added to every target's settings for this hostname and win over them, ie
+	// {"proxied": "true"}
+	Settings map[string]string `json:"settings"`
+}
+
+// targetResult is the outcome of applying an update to one target
+type targetResult struct {
+	target string
+	err    error
+}
+
+// compile checks the target's provider exists and it has every setting the provider's path needs
+func (t *Target) compile(name string) error {
+	p, found := providers[t.Provider]
+	if !found {
+		return errors.New("target " + name + " has unknown provider " + t.Provider)
+	}
+	for _, key := range p.path {
+		if t.Settings[key] == "" && !slices.Contains(p.optional, key) {
+			return errors.New("target " + name + " is missing setting " + key)
+		}
+	}
+	return nil
+}
+
+func (h *HostConfig) compile(hostname string, targets map[string]*Target) error {
+	if len(h.Targets) == 0 {
+		return errors.New("host " + hostname + " has no targets")
+	}
+	for _, name := range h.Targets {
+		if _, found := targets[name]; !found {
+			return errors.New("host " + hostname + " has unknown target " + name)
+		}
+	}
+	if h.Policy == "" {
+		h.Policy = policyAll
+	}
+	if h.Policy != policyAll && h.Policy != policyAny && h.Policy != policyFailover {
+		return errors.New("host " + hostname + " has invalid policy " + h.Policy)
+	}
+	return nil
+}
+
+// hostKey is how hostnames are looked up in the config, without case or a trailing dot
+func hostKey(hostname string) string {
+	return strings.TrimSuffix(strings.ToLower(hostname), ".")
+}
+
+// hostHandler handles /nic/update for the hostnames in the config, the response starts with the
+// combined dyndns return code followed by a line per target
+func hostHandler(w http.ResponseWriter, r *http.Request) {
+	client := r.Header.Get("X-Forwarded-For")
+	if client == "" {
+		client = r.RemoteAddr
+	}
+
+	update := &dnsUpdate{}
+	results, err := hostUpdate(r, update)
+	for _, result := range results {
+		if !applied(result.err) {
+			logger("client: "+client+" "+result.target+" "+result.err.Error(), "err")
+		} else {
+			logger("client: "+client+" successfully updated "+result.target+" DNS hostname: "+update.hostname+" ip: "+strings.Join(update.ips, ","), "info")
+		}
+	}
+	if err != nil && len(results) == 0 {
+		logger("client: "+client+" "+err.Error(), "err")
+	} else if err == nil && asyncEnabled() {
+		logger("client: "+client+" queued update hostname: "+update.hostname+" ip: "+strings.Join(update.ips, ","), "info")
+	}
+	respondTargets(w, update.ips, err, results)
+}
+
+// hostUpdate validates the request and applies it to the hostname's targets, update is filled in
+// as the request is read so it can be logged even when validation failed
+func hostUpdate(r *http.Request, update *dnsUpdate) ([]targetResult, error) {
+	var err error
+	update.ips, update.hostname, err = checkFormsMulti(r)
+	if err != nil {
+		return nil, err
+	}
+	update.ttl, err = checkTTL(r)
+	if err != nil {
+		return nil, err
+	}
+
+	host, found := config.Hosts[hostKey(update.hostname)]
+	if !found {
+		return nil, newDyndnsError(dyndnsNoHost, "hostname is not configured")
+	}
+	username, password, _ := r.BasicAuth()
+	if configClient(username, password) == nil || !slices.Contains(host.Clients, username) {
+		return nil, errUnauthorized
+	}
+
+	// form settings only fill in what neither the host nor its targets set
+	requested := make(map[string]string)
+	addFormSettings(r, requested)
+
+	if asyncEnabled() {
+		return nil, enqueueUpdate(&queuedUpdate{Host: true, Settings: requested, Hostname: update.hostname, IPs: update.ips, TTL: update.ttl})
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	results := applyTargets(ctx, host, update, requested)
+	return results, combineResults(host.Policy, results)
+}
+
+// applyTargets runs the update against the host's targets and returns their results in the
+// configured order, with failover only the targets that were tried are included and only the last
+// one is retried since moving on to the next is quicker than waiting for the first to recover
+func applyTargets(ctx context.Context, host *HostConfig, update *dnsUpdate, requested map[string]string) []targetResult {
+	if host.Policy == policyFailover {
+		var results []targetResult
+		for i, name := range host.Targets {
+			err := applyTarget(ctx, name, host, update, requested, i == len(host.Targets)-1)
+			results = append(results, targetResult{target: name, err: err})
+			if !isTransient(err) {
+				break
+			}
+		}
+		return results
+	}
+
+	results := make([]targetResult, len(host.Targets))
+	var wg sync.WaitGroup
+	for i, name := range host.Targets {
+		results[i].target = name
+		apply := func() {
+			results[i].err = applyTarget(ctx, name, host, update, requested, true)
+		}
+		if host.Parallel {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				apply()
+			}()
+		} else {
+			apply()
+		}
+	}
+	wg.Wait()
+	return results
+}
+
+// applyTarget updates one target, a target whose circuit is open is skipped without calling it,
+// the update waits for any other update to the same hostname on the provider that arrived first
+func applyTarget(ctx context.Context, name string, host *HostConfig, update *dnsUpdate, requested map[string]string, retry bool) error {
+	target := config.Targets[name]
+	// every target gets its own copy of the settings and update so none of them can affect another
+	settings := make(map[string]string)
+	for key, value := range target.Settings {
+		settings[key] = value
+	}
+	for key, value := range host.Settings {
+		settings[key] = value
+	}
+	for key, value := range requested {
+		if _, set := settings[key]; !set {
+			settings[key] = value
+		}
+	}
+	targetUpdate := *update
+	p := providers[target.Provider]
+	return coalesce(ctx, "target "+name, updateIdentity("target "+name, settings, &targetUpdate), &targetUpdate, func() error {
+		err := circuitAllow(name, time.Now())
+		if err != nil {
+			return err
+		}
+		err = withRetry(ctx, p.title+" target "+name, retry, func(ctx context.Context) error {
+			return p.update(ctx, settings, &targetUpdate)
+		})
+		circuitRecord(name, err, time.Now())
+		return err
+	})
+}
+
+// combineResults turns the per target results into one error under the policy, nochg is only
+// returned when no target changed anything and errPending when the only changes are still pending,
+// a failover that ran out of targets reports the error from the last one tried
+func combineResults(policy string, results []targetResult) error {
+	var failed error
+	var changed, pending, succeeded bool
+	for _, result := range results {
+		switch {
+		case result.err == nil:
+			changed, succeeded = true, true
+		case errors.Is(result.err, errPending):
+			pending, succeeded = true, true
+		case errors.Is(result.err, errNoChange):
+			succeeded = true
+		case failed == nil || policy == policyFailover:
+			failed = result.err
+		}
+	}
+	if failed != nil && (policy == policyAll || !succeeded) {
+		return failed
+	}
+	if changed {
+		return nil
+	}
+	if pending {
+		return errPending
+	}
+	return errNoChange
+}
+
+// respondTargets writes the combined result like respond does, followed by one line per target
+// ie "cloudflare: good"
+func respondTargets(w http.ResponseWriter, ips []string, err error, results []targetResult) {
+	code := dyndnsCode(err)
+	var body strings.Builder
+	if code == dyndnsGood || code == dyndnsNoChg {
+		body.WriteString(resultLine(code, ips, err) + "\n")
+	} else {
+		body.WriteString(code + " " + err.Error() + "\n")
+	}
+	for _, result := range results {
+		body.WriteString(result.target + ": " + dyndnsCode(result.err))
+		if result.err != nil && !errors.Is(result.err, errNoChange) {
+			body.WriteString(" " + result.err.Error())
+		}
+		body.WriteString("\n")
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(dyndnsStatus(code))
+	w.Write([]byte(body.String()))
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+)
+
+var gandiEndpoint = "https://api.gandi.net/v5/livedns"
+
+// Gandi LiveDNS rejects anything lower than this
+const gandiMinTTL = 300
+
+// Gandi LiveDNS RRSet structure
+type GandiRRSet struct {
+	Values []string `json:"rrset_values"`
+	TTL    int      `json:"rrset_ttl,omitempty"`
+}
+
+func gandiUpdate(ctx context.Context, settings map[string]string, update *dnsUpdate) error {
+	// gandi stores whole rrsets so every ip passed is kept, useful for dual-homed hosts
+	return gandiDoUpdate(ctx, settings["domain"], settings["token"], update.hostname, update.ips, update.ttl)
+}
+
+func gandiDoUpdate(ctx context.Context, domain, accessToken, hostname string, ips []string, ttl int) error {
+	headers := map[string]string{"Authorization": "Bearer " + accessToken}
+
+	// Extract subdomain from hostname, gandi names the zone apex @
+	subdomain, err := subdomainOf(hostname, domain)
+	if err != nil {
+		return err
+	}
+	if subdomain == "" {
+		subdomain = "@"
+	}
+
+	if ttl < gandiMinTTL {
+		ttl = gandiMinTTL
+	}
+
+	// PUT replaces the whole rrset so it creates or updates in one call, one call per record type
+	rrsets := ipsByType(ips)
+	for _, fieldType := range []string{"A", "AAAA"} {
+		values := rrsets[fieldType]
+		if len(values) == 0 {
+			continue
+		}
+		path := "/domains/" + url.PathEscape(domain) + "/records/" + url.PathEscape(subdomain) + "/" + fieldType
+		err = apiRequest(ctx, "Gandi", "PUT", gandiEndpoint+path, headers, GandiRRSet{Values: values, TTL: ttl}, nil)
+		if err != nil {
+			return fmt.Errorf("failed to update %s record: %w", fieldType, err)
+		}
+	}
+
+	return nil
+}
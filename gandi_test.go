@@ -0,0 +1,62 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestGandiUpdate(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostname string
+		ips      []string
+		ttl      int
+		want     []string
+		wantSets []GandiRRSet
+	}{
+		{"one rrset per type with every value", "home.example.com", []string{"192.0.2.1", "2001:db8::1", "192.0.2.2"}, 600,
+			[]string{"PUT /domains/example.com/records/home/A", "PUT /domains/example.com/records/home/AAAA"},
+			[]GandiRRSet{{Values: []string{"192.0.2.1", "192.0.2.2"}, TTL: 600}, {Values: []string{"2001:db8::1"}, TTL: 600}}},
+		{"apex is named @ and the ttl raised to the minimum", "example.com", []string{"192.0.2.1"}, 60,
+			[]string{"PUT /domains/example.com/records/@/A"},
+			[]GandiRRSet{{Values: []string{"192.0.2.1"}, TTL: gandiMinTTL}}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := startMockAPI(t, &gandiEndpoint, func(w http.ResponseWriter, call apiCall) {
+				w.WriteHeader(http.StatusCreated)
+				w.Write([]byte(`{"message":"DNS Record Created"}`))
+			})
+			err := gandiDoUpdate(t.Context(), "example.com", "token", test.hostname, test.ips, test.ttl)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := mock.requests(); !slices.Equal(got, test.want) {
+				t.Errorf("requests = %v, want %v", got, test.want)
+			}
+			for i, call := range mock.received() {
+				if call.header.Get("Authorization") != "Bearer token" {
+					t.Errorf("Authorization = %q", call.header.Get("Authorization"))
+				}
+				var body GandiRRSet
+				json.Unmarshal([]byte(call.body), &body)
+				if !slices.Equal(body.Values, test.wantSets[i].Values) || body.TTL != test.wantSets[i].TTL {
+					t.Errorf("rrset %d = %+v, want %+v", i, body, test.wantSets[i])
+				}
+			}
+		})
+	}
+}
+
+func TestGandiUpdateHostnameOutsideDomain(t *testing.T) {
+	mock := startMockAPI(t, &gandiEndpoint, func(w http.ResponseWriter, call apiCall) {})
+	err := gandiDoUpdate(t.Context(), "example.com", "token", "home.example.org", []string{"192.0.2.1"}, 300)
+	if classifyError(err) != errorNotFound {
+		t.Errorf("err = %v, want nohost", err)
+	}
+	if len(mock.requests()) != 0 {
+		t.Errorf("requests = %v, want none", mock.requests())
+	}
+}
@@ -0,0 +1,169 @@
+package main
+
+// This file tracks the health of the configured targets, a target that keeps failing has its
+// circuit opened for a while so requests skip it straight away instead of waiting on a provider
+// api that's down, after the cooldown one request is let through to see if it's back
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultFailureThreshold = 3
+	defaultCircuitCooldown  = 60 * time.Second
+)
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half-open"
+)
+
+// HealthConfig is the "health" section of the config
+type HealthConfig struct {
+	// FailureThreshold is how many failures in a row open a target's circuit, defaults to 3
+	FailureThreshold int `json:"failureThreshold"`
+	// Cooldown is a go duration like "60s", how long an open circuit skips the target
+	Cooldown string `json:"cooldown"`
+
+	cooldown time.Duration
+}
+
+// targetHealth is the health of one target, only transient failures count against it since a
+// bad login or unknown zone doesn't mean the provider is down
+type targetHealth struct {
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	Successes           int64     `json:"successes"`
+	Failures            int64     `json:"failures"`
+	LastSuccess         time.Time `json:"lastSuccess,omitzero"`
+	LastFailure         time.Time `json:"lastFailure,omitzero"`
+	LastError           string    `json:"lastError,omitempty"`
+	OpenUntil           time.Time `json:"openUntil,omitzero"`
+
+	// trial is set while the one request allowed through a half open circuit is running
+	trial bool
+}
+
+var healthTracker = struct {
+	sync.Mutex
+	targets map[string]*targetHealth
+}{targets: make(map[string]*targetHealth)}
+
+func (c *HealthConfig) compile() error {
+	if c.FailureThreshold == 0 {
+		c.FailureThreshold = defaultFailureThreshold
+	}
+	if c.FailureThreshold < 1 {
+		return errors.New("health has an invalid failure threshold")
+	}
+	c.cooldown = defaultCircuitCooldown
+	if c.Cooldown != "" {
+		cooldown, err := time.ParseDuration(c.Cooldown)
+		if err != nil || cooldown <= 0 {
+			return errors.New("health has an invalid cooldown")
+		}
+		c.cooldown = cooldown
+	}
+	return nil
+}
+
+// healthSettings returns the configured health settings or the defaults
+func healthSettings() *HealthConfig {
+	if config.Health != nil {
+		return config.Health
+	}
+	return &HealthConfig{FailureThreshold: defaultFailureThreshold, cooldown: defaultCircuitCooldown}
+}
+
+// isTransient reports whether err could go away on its own, a target failing this way is worth
+// failing over from and counts against its health, errors that can't be classified count too
+// since the next target may well work where this one didn't
+func isTransient(err error) bool {
+	if applied(err) {
+		return false
+	}
+	switch classifyError(err) {
+	case errorTransient, errorRateLimited, errorUnknown:
+		return true
+	}
+	return false
+}
+
+// circuitAllow reports whether a request may go to the target, it's refused while the circuit is
+// open and only one request at a time is let through once the cooldown is over
+func circuitAllow(name string, now time.Time) error {
+	healthTracker.Lock()
+	defer healthTracker.Unlock()
+	h := healthTracker.targets[name]
+	if h == nil || h.OpenUntil.IsZero() {
+		return nil
+	}
+	if now.Before(h.OpenUntil) || h.trial {
+		return newDyndnsError(dyndns911, "target "+name+" skipped after "+strconv.Itoa(h.ConsecutiveFailures)+" failures, last error: "+h.LastError)
+	}
+	h.trial = true
+	return nil
+}
+
+// circuitRecord updates the target's health with the result of a request
+func circuitRecord(name string, err error, now time.Time) {
+	settings := healthSettings()
+	healthTracker.Lock()
+	defer healthTracker.Unlock()
+	h := healthTracker.targets[name]
+	if h == nil {
+		h = &targetHealth{}
+		healthTracker.targets[name] = h
+	}
+	h.trial = false
+	if !isTransient(err) {
+		h.ConsecutiveFailures = 0
+		h.OpenUntil = time.Time{}
+		if applied(err) {
+			h.Successes++
+			h.LastSuccess = now
+		}
+		return
+	}
+	h.Failures++
+	h.ConsecutiveFailures++
+	h.LastFailure = now
+	h.LastError = err.Error()
+	if h.ConsecutiveFailures >= settings.FailureThreshold {
+		if h.OpenUntil.IsZero() {
+			logger("target "+name+" failed "+strconv.Itoa(h.ConsecutiveFailures)+" times in a row, skipping it for "+settings.cooldown.String(), "notice")
+		}
+		h.OpenUntil = now.Add(settings.cooldown)
+	}
+}
+
+// targetStatus is a target's health as shown by /status
+type targetStatus struct {
+	Provider string `json:"provider"`
+	State    string `json:"state"`
+	targetHealth
+}
+
+// healthStatus returns the health of every configured target
+func healthStatus(now time.Time) map[string]targetStatus {
+	healthTracker.Lock()
+	defer healthTracker.Unlock()
+	targets := make(map[string]targetStatus)
+	for name, target := range config.Targets {
+		status := targetStatus{Provider: target.Provider, State: circuitClosed}
+		if h := healthTracker.targets[name]; h != nil {
+			status.targetHealth = *h
+			if !h.OpenUntil.IsZero() {
+				status.State = circuitOpen
+				if !now.Before(h.OpenUntil) {
+					status.State = circuitHalfOpen
+				}
+			}
+		}
+		targets[name] = status
+	}
+	return targets
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+var hetznerEndpoint = "https://dns.hetzner.com/api/v1"
+
+// Hetzner DNS Zone structure
+type HetznerZone struct {
+	ID   string `json:"id"`
+	Name string `json:"name"`
+}
+
+// Hetzner DNS Record structure
+type HetznerRecord struct {
+	ID     string `json:"id,omitempty"`
+	ZoneID string `json:"zone_id"`
+	Type   string `json:"type"`
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	TTL    int    `json:"ttl,omitempty"`
+}
+
+// Hetzner list responses are paginated, meta tells us when we've reached the last page
+type hetznerMeta struct {
+	Pagination struct {
+		Page     int `json:"page"`
+		LastPage int `json:"last_page"`
+	} `json:"pagination"`
+}
+
+func hetznerUpdate(ctx context.Context, settings map[string]string, update *dnsUpdate) error {
+	// Hetzner works the same way as DigitalOcean, zone name as username and api token as password
+	for _, ip := range update.primaryIPs() {
+		err := hetznerDoUpdate(ctx, settings["zone"], settings["token"], update.hostname, ip, update.ttl)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func hetznerDoUpdate(ctx context.Context, zoneName, apiToken, hostname, ip string, ttl int) error {
+	headers := map[string]string{"Auth-API-Token": apiToken}
+
+	// Get the record name (subdomain part), hetzner uses @ for the zone apex
+	var recordName string
+	if hostname == zoneName {
+		recordName = "@"
+	} else if strings.HasSuffix(hostname, "."+zoneName) {
+		recordName = strings.TrimSuffix(hostname, "."+zoneName)
+	} else {
+		return newDyndnsError(dyndnsNoHost, "hostname "+hostname+" does not belong to zone "+zoneName)
+	}
+	recType := recordType(ip)
+
+	// Look up the zone id from the zone name
+	var zones struct {
+		Zones []HetznerZone `json:"zones"`
+	}
+	err := apiRequest(ctx, "Hetzner", "GET", hetznerEndpoint+"/zones?name="+url.QueryEscape(zoneName), headers, nil, &zones)
+	if err != nil {
+		return fmt.Errorf("failed to look up zone: %w", err)
+	}
+	var zoneID string
+	for _, zone := range zones.Zones {
+		if zone.Name == zoneName {
+			zoneID = zone.ID
+			break
+		}
+	}
+	if zoneID == "" {
+		return newDyndnsError(dyndnsNoHost, "zoneName not found (should be provided as username in hetzner mode)")
+	}
+
+	// Check if DNS Record exists, walking every page of the zone's records
+	var existingRecord *HetznerRecord
+	for page := 1; existingRecord == nil; page++ {
+		var records struct {
+			Records []HetznerRecord `json:"records"`
+			Meta    hetznerMeta     `json:"meta"`
+		}
+		err = apiRequest(ctx, "Hetzner", "GET", hetznerEndpoint+"/records?zone_id="+url.QueryEscape(zoneID)+"&per_page=100&page="+strconv.Itoa(page), headers, nil, &records)
+		if err != nil {
+			return fmt.Errorf("failed to list DNS records: %w", err)
+		}
+		for i := range records.Records {
+			if records.Records[i].Name == recordName && records.Records[i].Type == recType {
+				existingRecord = &records.Records[i]
+				break
+			}
+		}
+		if page >= records.Meta.Pagination.LastPage {
+			break
+		}
+	}
+
+	record := HetznerRecord{
+		ZoneID: zoneID,
+		Type:   recType,
+		Name:   recordName,
+		Value:  ip,
+		TTL:    ttl,
+	}
+	if existingRecord != nil {
+		// Update existing record
+		err = apiRequest(ctx, "Hetzner", "PUT", hetznerEndpoint+"/records/"+url.PathEscape(existingRecord.ID), headers, record, nil)
+		if err != nil {
+			return fmt.Errorf("failed to update DNS record: %w", err)
+		}
+	} else {
+		// Create new record
+		err = apiRequest(ctx, "Hetzner", "POST", hetznerEndpoint+"/records", headers, record, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create DNS record: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+// hetznerAPI answers like the hetzner dns api for example.com, with records spread over pages
+// of two
+func hetznerAPI(records []HetznerRecord) func(w http.ResponseWriter, call apiCall) {
+	return func(w http.ResponseWriter, call apiCall) {
+		query, _ := url.ParseQuery(call.query)
+		switch {
+		case call.method == "GET" && call.path == "/zones":
+			// the name filter is a search, similar names come back too
+			zones := []HetznerZone{{ID: "z-other", Name: "sub.example.com"}}
+			if query.Get("name") == "example.com" {
+				zones = append(zones, HetznerZone{ID: "z1", Name: "example.com"})
+			}
+			json.NewEncoder(w).Encode(map[string]any{"zones": zones})
+		case call.method == "GET" && call.path == "/records":
+			if query.Get("zone_id") != "z1" {
+				w.WriteHeader(http.StatusNotFound)
+				return
+			}
+			var page int
+			fmt.Sscan(query.Get("page"), &page)
+			lastPage := max((len(records)+1)/2, 1)
+			start, end := min((page-1)*2, len(records)), min(page*2, len(records))
+			var body struct {
+				Records []HetznerRecord `json:"records"`
+				Meta    hetznerMeta     `json:"meta"`
+			}
+			body.Records = records[start:end]
+			body.Meta.Pagination.Page = page
+			body.Meta.Pagination.LastPage = lastPage
+			json.NewEncoder(w).Encode(body)
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}
+}
+
+func TestHetznerUpdate(t *testing.T) {
+	records := []HetznerRecord{
+		{ID: "r1", Type: "MX", Name: "@", Value: "10 mail.example.com."},
+		{ID: "r2", Type: "TXT", Name: "home", Value: "v=spf1 -all"},
+		{ID: "r3", Type: "A", Name: "www", Value: "192.0.2.10"},
+		{ID: "r4", Type: "AAAA", Name: "home", Value: "2001:db8::1"},
+		{ID: "r5", Type: "A", Name: "home", Value: "192.0.2.1"},
+	}
+	tests := []struct {
+		name     string
+		zone     string
+		hostname string
+		ip       string
+		want     []string
+		wantBody HetznerRecord
+		wantErr  string
+	}{
+		{"record on the last page is updated", "example.com", "home.example.com", "192.0.2.2",
+			[]string{"GET /zones", "GET /records", "GET /records", "GET /records", "PUT /records/r5"},
+			HetznerRecord{ZoneID: "z1", Type: "A", Name: "home", Value: "192.0.2.2", TTL: 300}, ""},
+		{"record on the second page stops the walk", "example.com", "home.example.com", "2001:db8::2",
+			[]string{"GET /zones", "GET /records", "GET /records", "PUT /records/r4"},
+			HetznerRecord{ZoneID: "z1", Type: "AAAA", Name: "home", Value: "2001:db8::2", TTL: 300}, ""},
+		{"missing record is created after every page", "example.com", "new.example.com", "192.0.2.3",
+			[]string{"GET /zones", "GET /records", "GET /records", "GET /records", "POST /records"},
+			HetznerRecord{ZoneID: "z1", Type: "A", Name: "new", Value: "192.0.2.3", TTL: 300}, ""},
+		{"apex is named @", "example.com", "example.com", "192.0.2.4",
+			[]string{"GET /zones", "GET /records", "GET /records", "GET /records", "POST /records"},
+			HetznerRecord{ZoneID: "z1", Type: "A", Name: "@", Value: "192.0.2.4", TTL: 300}, ""},
+		{"unknown zone", "example.org", "home.example.org", "192.0.2.1",
+			[]string{"GET /zones"}, HetznerRecord{}, dyndnsNoHost},
+		{"hostname outside the zone", "example.com", "home.example.org", "192.0.2.1",
+			nil, HetznerRecord{}, dyndnsNoHost},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := startMockAPI(t, &hetznerEndpoint, hetznerAPI(records))
+			err := hetznerDoUpdate(t.Context(), test.zone, "token", test.hostname, test.ip, 300)
+			if test.wantErr != "" {
+				var dyndnsErr *dyndnsError
+				if !errors.As(err, &dyndnsErr) || dyndnsErr.code != test.wantErr {
+					t.Fatalf("err = %v, want %s", err, test.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := mock.requests(); !slices.Equal(got, test.want) {
+				t.Errorf("requests = %v, want %v", got, test.want)
+			}
+			if test.wantErr != "" {
+				return
+			}
+			write := mock.last()
+			if write.header.Get("Auth-API-Token") != "token" {
+				t.Errorf("Auth-API-Token = %q", write.header.Get("Auth-API-Token"))
+			}
+			var body HetznerRecord
+			json.Unmarshal([]byte(write.body), &body)
+			if body != test.wantBody {
+				t.Errorf("body = %+v, want %+v", body, test.wantBody)
+			}
+		})
+	}
+}
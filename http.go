@@ -1,20 +1,69 @@
 package main
 
-// This file contains the generic DDNS related functions and http handlers for each cloud service
+// This file contains the generic DDNS related functions and the http handler shared by every cloud service
 // for cloud service specific functions stored in there own CLOUDNAME.go files in the same directory
 
 import (
-	"errors"
+	"context"
 	"net"
 	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
 )
 
-var user, pass string
-var ok bool
+// dnsUpdate is a validated dyndns request, it is what every provider is handed to apply
+type dnsUpdate struct {
+	hostname string
+	ips      []string
+	ttl      int
+}
+
+// provider describes how a dns service is reached over http and how it applies an update
+type provider struct {
+	// title is the provider name used in log messages
+	title string
+	// path are the settings read from the url path after /name/, in order
+	path []string
+	// optional are the path settings that may be left empty, the provider works them out itself,
+	// only the trailing ones can be left out of the url path
+	optional []string
+	// user and pass are the settings the basic auth username and password are passed through as,
+	// a provider without them can only be used by clients from the server config
+	user, pass string
+	// update applies the update with the settings gathered by requestSettings
+	update func(ctx context.Context, settings map[string]string, update *dnsUpdate) error
+}
+
+var providers = map[string]*provider{
+	"aws":          {title: "AWS", path: []string{"zoneid"}, optional: []string{"zoneid"}, user: "accesskey", pass: "secretkey", update: awsUpdate},
+	"cloudflare":   {title: "Cloudflare", user: "zone", pass: "token", update: cfUpdate},
+	"digitalocean": {title: "DigitalOcean", user: "domain", pass: "token", update: doUpdate},
+	"azure":        {title: "Azure", path: []string{"tenantid", "subscriptionid", "resourcegroup", "zone"}, optional: []string{"tenantid"}, user: "clientid", pass: "clientsecret", update: azureUpdate},
+	"azureprivate": {title: "Azure Private DNS", path: []string{"tenantid", "subscriptionid", "resourcegroup", "zone"}, optional: []string{"tenantid"}, user: "clientid", pass: "clientsecret", update: azurePrivateUpdate},
+	"ovh":          {title: "OVH", path: []string{"endpoint", "domain", "appkey"}, optional: []string{"appkey"}, user: "appsecret", pass: "consumerkey", update: ovhUpdate},
+	"hetzner":      {title: "Hetzner", user: "zone", pass: "token", update: hetznerUpdate},
+	"gandi":        {title: "Gandi", user: "domain", pass: "token", update: gandiUpdate},
+	"linode":       {title: "Linode", user: "domain", pass: "token", update: linodeUpdate},
+	"porkbun":      {title: "Porkbun", path: []string{"domain"}, user: "apikey", pass: "secretapikey", update: porkbunUpdate},
+	"namecheap":    {title: "Namecheap", path: []string{"domain", "clientip"}, user: "apiuser", pass: "apikey", update: namecheapUpdate},
+	"desec":        {title: "deSEC", user: "domain", pass: "token", update: desecUpdate},
+	"http":         {title: "HTTP", path: []string{"name"}, update: webhookUpdate},
+	"exec":         {title: "Exec", path: []string{"name"}, update: execUpdate},
+	"zonefile":     {title: "Zone file", path: []string{"name"}, update: zoneFileUpdate},
+	"dnsserver":    {title: "DNS server", update: dnsServerUpdate},
+}
+
+// formSettings are optional settings a request may also give as form values, ie multivalue=true,
+// a value from the server config wins
+var formSettings = []string{"multivalue", "wait", "proxied"}
+
+var errUnauthorized = newDyndnsError(dyndnsBadAuth, "you are unauthorized to use this provider")
 
 func BasicAuth(handler http.HandlerFunc) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		user, pass, ok = r.BasicAuth()
+		_, _, ok := r.BasicAuth()
 
 		if !ok {
 			w.Header().Set("WWW-Authenticate", `Basic realm="Please enter your username and password"`)
@@ -23,42 +72,290 @@ func BasicAuth(handler http.HandlerFunc) http.HandlerFunc {
 			return
 		}
 
-		// fmt.Printf("Username: %s, Password: %s\n", user, pass)
 		handler(w, r)
 	}
 }
 
-func checkForms(r *http.Request) (ip string, hostname string, err error) {
+// updateHandler returns the handler for /name/, every provider goes through the same steps
+// only the settings it needs and how it applies the update differ
+func updateHandler(name string) http.HandlerFunc {
+	p := providers[name]
+	return func(w http.ResponseWriter, r *http.Request) {
+		client := r.Header.Get("X-Forwarded-For")
+		if client == "" {
+			client = r.RemoteAddr
+		}
+
+		update, err := providerUpdate(r, name)
+		respond(w, update.ips, err)
+		if !applied(err) {
+			logger("client: "+client+" "+name+" "+err.Error(), "err")
+		} else if asyncEnabled() {
+			logger("client: "+client+" queued "+p.title+" DNS update hostname: "+update.hostname+" ip: "+strings.Join(update.ips, ","), "info")
+		} else {
+			logger("client: "+client+" successfully updated "+p.title+" DNS hostname: "+update.hostname+" ip: "+strings.Join(update.ips, ","), "info")
+		}
+	}
+}
+
+// providerUpdate validates the request and applies it with the named provider, or queues it in
+// async mode, the returned update is never nil so its fields can be logged even when validation failed
+func providerUpdate(r *http.Request, name string) (*dnsUpdate, error) {
+	update := &dnsUpdate{}
+	var err error
+	update.ips, update.hostname, err = checkFormsMulti(r)
+	if err != nil {
+		return update, err
+	}
+	update.ttl, err = checkTTL(r)
+	if err != nil {
+		return update, err
+	}
+	settings, err := requestSettings(r, name)
+	if err != nil {
+		return update, err
+	}
+	if asyncEnabled() {
+		return update, enqueueUpdate(&queuedUpdate{Provider: name, Settings: settings, Hostname: update.hostname, IPs: update.ips, TTL: update.ttl})
+	}
+	ctx, cancel := requestContext()
+	defer cancel()
+	return update, applyProvider(ctx, name, settings, update)
+}
+
+// applyProvider applies an update with the named provider, retrying errors that might go away,
+// after any other update to the same hostname that arrived first
+func applyProvider(ctx context.Context, name string, settings map[string]string, update *dnsUpdate) error {
+	p := providers[name]
+	return coalesce(ctx, name, updateIdentity(name, settings, update), update, func() error {
+		return withRetry(ctx, p.title, true, func(ctx context.Context) error {
+			return p.update(ctx, settings, update)
+		})
+	})
+}
+
+// requestSettings gathers the provider settings for a request, the url path fills in the path
+// settings and then either the server config for a configured client or the pass-through basic
+// auth credentials fill in the rest, config values win over the url so a client can't leave its zone
+func requestSettings(r *http.Request, name string) (map[string]string, error) {
+	p := providers[name]
+	username, password, _ := r.BasicAuth()
+	settings := make(map[string]string)
+
+	// path parts are positional so an optional one can only be left out of the path when nothing
+	// required follows it, one further up can still be left out of the config
+	format := "/" + name + "/"
+	for i, key := range p.path {
+		if p.trailingOptional(i) {
+			format += "[" + key + "/]"
+		} else {
+			format += key + "/"
+		}
+	}
+	var pathComponents []string
+	if trimmed := strings.Trim(strings.TrimPrefix(r.URL.Path, "/"+name+"/"), "/"); trimmed != "" {
+		pathComponents = strings.Split(trimmed, "/")
+	}
+	if len(pathComponents) > len(p.path) {
+		return nil, newDyndnsError(dyndnsBadAgent, "invalid path format - expected "+format)
+	}
+	for i, value := range pathComponents {
+		if value != "" {
+			settings[p.path[i]] = value
+		}
+	}
+
+	if _, configured := config.Clients[username]; configured {
+		// a configured username with the wrong password is refused rather than passed through,
+		// otherwise the password would be sent to the provider as its credentials
+		client := configClient(username, password)
+		if client == nil {
+			return nil, errUnauthorized
+		}
+		clientSettings, ok := client.Providers[name]
+		if !ok {
+			return nil, errUnauthorized
+		}
+		for key, value := range clientSettings {
+			settings[key] = value
+		}
+	} else if p.user == "" {
+		// nothing to pass through, only clients from the server config can use this provider
+		return nil, errUnauthorized
+	} else {
+		settings[p.user] = username
+		settings[p.pass] = password
+	}
+
+	addFormSettings(r, settings)
+
+	for _, key := range p.path {
+		if settings[key] == "" && !slices.Contains(p.optional, key) {
+			return nil, newDyndnsError(dyndnsBadAgent, "invalid path format - expected "+format)
+		}
+	}
+	return settings, nil
+}
+
+// trailingOptional reports whether the path part at index and every one after it are optional
+func (p *provider) trailingOptional(index int) bool {
+	for _, key := range p.path[index:] {
+		if !slices.Contains(p.optional, key) {
+			return false
+		}
+	}
+	return true
+}
+
+// addFormSettings adds the form settings given with the request to settings, without replacing
+// any already set
+func addFormSettings(r *http.Request, settings map[string]string) {
+	for _, key := range formSettings {
+		if _, set := settings[key]; !set && r.Form.Has(key) {
+			settings[key] = r.Form.Get(key)
+		}
+	}
+}
+
+// settingBool reads an optional true or false setting, unset is false
+func settingBool(settings map[string]string, key string) (bool, error) {
+	if settings[key] == "" {
+		return false, nil
+	}
+	value, err := strconv.ParseBool(settings[key])
+	if err != nil {
+		return false, newDyndnsError(dyndnsBadAgent, key+" invalid")
+	}
+	return value, nil
+}
+
+// settingDuration reads a duration setting, fallback when it isn't set
+func settingDuration(settings map[string]string, key string, fallback time.Duration) (time.Duration, error) {
+	if settings[key] == "" {
+		return fallback, nil
+	}
+	value, err := time.ParseDuration(settings[key])
+	if err != nil || value <= 0 {
+		return 0, newDyndnsError(dyndnsBadAgent, key+" invalid")
+	}
+	return value, nil
+}
+
+func checkFormsMulti(r *http.Request) (ips []string, hostname string, err error) {
 	// since dyndns proto always requires these 2 form values generic function for checking them
+	// ip may be repeated or comma separated for hosts with more than one address
 	err = r.ParseForm()
 	if err != nil {
-		err = errors.New("failed to parse form")
-		return "", "", err
+		err = newDyndnsError(dyndnsBadAgent, "failed to parse form")
+		return nil, "", err
 	}
 	var ipCheck []string
 	var check bool
 	ipCheck, check = r.Form["ip"]
 	if !check {
-		err = errors.New("required form value \"ip\"")
-		return "", "", err
-	} else if net.ParseIP(ipCheck[0]) == nil {
-		err = errors.New("ip address invalid")
-		return "", "", err
-	} else {
-		ip = ipCheck[0]
+		err = newDyndnsError(dyndnsBadAgent, "required form value \"ip\"")
+		return nil, "", err
+	}
+	for _, value := range ipCheck {
+		for _, ip := range strings.Split(value, ",") {
+			ip = strings.TrimSpace(ip)
+			if net.ParseIP(ip) == nil {
+				err = newDyndnsError(dyndnsBadAgent, "ip address invalid")
+				return nil, "", err
+			}
+			ips = append(ips, ip)
+		}
 	}
 	var nameCheck []string
 	nameCheck, check = r.Form["hostname"]
 	if !check {
 		nameCheck, check = r.Form["host"]
 		if !check {
-			err = errors.New("required form value \"hostname\"")
-			return "", "", err
+			err = newDyndnsError(dyndnsNotFQDN, "required form value \"hostname\"")
+			return nil, "", err
 		} else {
 			hostname = nameCheck[0]
 		}
 	} else {
 		hostname = nameCheck[0]
 	}
-	return ip, hostname, nil
+	if !validHostname(hostname) {
+		err = newDyndnsError(dyndnsNotFQDN, "hostname invalid")
+		return nil, "", err
+	}
+	return ips, hostname, nil
+}
+
+// validHostname reports whether hostname is made of plain letter, digit and hyphen labels with an
+// optional trailing dot, providers build records and api paths from it so nothing else gets through
+func validHostname(hostname string) bool {
+	hostname = strings.TrimSuffix(hostname, ".")
+	if hostname == "" || len(hostname) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(hostname, ".") {
+		if label == "" || len(label) > 63 {
+			return false
+		}
+		for _, c := range label {
+			if (c < 'a' || c > 'z') && (c < 'A' || c > 'Z') && (c < '0' || c > '9') && c != '-' {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func checkTTL(r *http.Request) (ttl int, err error) {
+	// ttl is optional, providers used a fixed 300 before it could be set so keep that as the default
+	ttlCheck := r.Form.Get("ttl")
+	if ttlCheck == "" {
+		return 300, nil
+	}
+	ttl, err = strconv.Atoi(ttlCheck)
+	if err != nil || ttl < 1 {
+		return 0, newDyndnsError(dyndnsBadAgent, "ttl invalid")
+	}
+	return ttl, nil
+}
+
+// recordType returns the record type needed to store ip, AAAA for ipv6 and A for everything else
+func recordType(ip string) string {
+	if net.ParseIP(ip).To4() == nil {
+		return "AAAA"
+	}
+	return "A"
+}
+
+// primaryIPs returns the first address of each record type, for providers that store a single
+// value per record rather than whole rrsets
+func (u *dnsUpdate) primaryIPs() []string {
+	var primary []string
+	byType := ipsByType(u.ips)
+	for _, fieldType := range []string{"A", "AAAA"} {
+		if len(byType[fieldType]) > 0 {
+			primary = append(primary, byType[fieldType][0])
+		}
+	}
+	return primary
+}
+
+// ipsByType groups ips into the A and AAAA record sets they belong in
+func ipsByType(ips []string) map[string][]string {
+	rrsets := make(map[string][]string)
+	for _, ip := range ips {
+		rrsets[recordType(ip)] = append(rrsets[recordType(ip)], ip)
+	}
+	return rrsets
+}
+
+// subdomainOf returns the part of hostname in front of domain, or "" when hostname is the domain itself
+func subdomainOf(hostname, domain string) (string, error) {
+	if hostname == domain {
+		return "", nil
+	}
+	if strings.HasSuffix(hostname, "."+domain) {
+		return strings.TrimSuffix(hostname, "."+domain), nil
+	}
+	return "", newDyndnsError(dyndnsNoHost, "hostname does not match domain")
 }
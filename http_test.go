@@ -0,0 +1,106 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestRequestSettingsConfiguredClient(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = &Config{Clients: map[string]*ClientConfig{
+		"router": {Password: "right", Providers: map[string]map[string]string{
+			"linode": {"domain": "example.com", "token": "configured-token"},
+		}},
+	}}
+
+	tests := []struct {
+		name     string
+		username string
+		password string
+		wantErr  error
+		want     map[string]string
+	}{
+		{"configured client", "router", "right", nil, map[string]string{"domain": "example.com", "token": "configured-token"}},
+		{"configured username wrong password", "router", "wrong", errUnauthorized, nil},
+		{"configured username empty password", "router", "", errUnauthorized, nil},
+		{"unknown username passed through", "example.org", "pass-token", nil, map[string]string{"domain": "example.org", "token": "pass-token"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/linode/?ip=192.0.2.1&hostname=home.example.com", nil)
+			r.SetBasicAuth(test.username, test.password)
+			r.ParseForm()
+			settings, err := requestSettings(r, "linode")
+			if !errors.Is(err, test.wantErr) {
+				t.Fatalf("err = %v, want %v", err, test.wantErr)
+			}
+			if err != nil {
+				if settings != nil {
+					t.Fatalf("settings = %v, want nil on error", settings)
+				}
+				return
+			}
+			for key, value := range test.want {
+				if settings[key] != value {
+					t.Errorf("settings[%q] = %q, want %q", key, settings[key], value)
+				}
+			}
+		})
+	}
+}
+
+func TestRequestSettingsOptionalPath(t *testing.T) {
+	saved := config
+	defer func() { config = saved }()
+	config = &Config{Clients: map[string]*ClientConfig{
+		"router": {Password: "right", Providers: map[string]map[string]string{
+			"azure": {"subscriptionid": "sub", "resourcegroup": "rg", "zone": "example.com", "credential": "managedidentity"},
+		}},
+	}}
+
+	tests := []struct {
+		name     string
+		provider string
+		path     string
+		username string
+		wantErr  string
+		want     map[string]string
+	}{
+		{"trailing optional left out", "aws", "/aws/", "AKIA", "", map[string]string{"zoneid": ""}},
+		{"trailing optional given", "aws", "/aws/Z123/", "AKIA", "", map[string]string{"zoneid": "Z123"}},
+		{"leading optional can't be left out of the path", "azure", "/azure/sub/rg/example.com/", "client",
+			"invalid path format - expected /azure/tenantid/subscriptionid/resourcegroup/zone/", nil},
+		{"leading optional given", "azure", "/azure/tenant/sub/rg/example.com/", "client", "",
+			map[string]string{"tenantid": "tenant", "subscriptionid": "sub", "resourcegroup": "rg", "zone": "example.com"}},
+		{"leading optional left out of the config", "azure", "/azure/", "router", "",
+			map[string]string{"tenantid": "", "subscriptionid": "sub", "zone": "example.com"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", test.path+"?ip=192.0.2.1&hostname=home.example.com", nil)
+			password := "secret"
+			if test.username == "router" {
+				password = "right"
+			}
+			r.SetBasicAuth(test.username, password)
+			r.ParseForm()
+			settings, err := requestSettings(r, test.provider)
+			if test.wantErr != "" {
+				if err == nil || err.Error() != test.wantErr {
+					t.Fatalf("err = %v, want %q", err, test.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			for key, value := range test.want {
+				if settings[key] != value {
+					t.Errorf("settings[%q] = %q, want %q", key, settings[key], value)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+var linodeEndpoint = "https://api.linode.com/v4"
+
+// Linode Domain structure
+type LinodeDomain struct {
+	ID     int    `json:"id"`
+	Domain string `json:"domain"`
+}
+
+// Linode Domain Record structure
+type LinodeRecord struct {
+	ID     int    `json:"id,omitempty"`
+	Type   string `json:"type,omitempty"`
+	Name   string `json:"name"`
+	Target string `json:"target"`
+	TTL    int    `json:"ttl_sec,omitempty"`
+}
+
+func linodeUpdate(ctx context.Context, settings map[string]string, update *dnsUpdate) error {
+	// credentials are either passed through like DigitalOcean (domain as username, api token as
+	// password) or come from the server config
+	for _, ip := range update.primaryIPs() {
+		err := linodeDoUpdate(ctx, settings["domain"], settings["token"], update.hostname, ip, update.ttl)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func linodeDoUpdate(ctx context.Context, domainName, apiToken, hostname, ip string, ttl int) error {
+	headers := map[string]string{"Authorization": "Bearer " + apiToken}
+
+	// Get the record name (subdomain part), linode names the zone apex with an empty string
+	recordName, err := subdomainOf(hostname, domainName)
+	if err != nil {
+		return err
+	}
+	recType := recordType(ip)
+
+	// Resolve the domain id, the filter header saves paging through every domain on the account
+	filter, _ := json.Marshal(map[string]string{"domain": domainName})
+	filterHeaders := map[string]string{"Authorization": headers["Authorization"], "X-Filter": string(filter)}
+	var domains struct {
+		Data []LinodeDomain `json:"data"`
+	}
+	err = apiRequest(ctx, "Linode", "GET", linodeEndpoint+"/domains", filterHeaders, nil, &domains)
+	if err != nil {
+		return fmt.Errorf("failed to look up domain: %w", err)
+	}
+	var domainID int
+	for _, domain := range domains.Data {
+		if strings.EqualFold(domain.Domain, domainName) {
+			domainID = domain.ID
+			break
+		}
+	}
+	if domainID == 0 {
+		return newDyndnsError(dyndnsNoHost, "domain not found (should be provided as username in linode mode)")
+	}
+	recordsPath := linodeEndpoint + "/domains/" + strconv.Itoa(domainID) + "/records"
+
+	// Check if DNS Record exists, walking every page of the domain's records
+	var existingRecord *LinodeRecord
+	for page := 1; existingRecord == nil; page++ {
+		var records struct {
+			Data  []LinodeRecord `json:"data"`
+			Page  int            `json:"page"`
+			Pages int            `json:"pages"`
+		}
+		err = apiRequest(ctx, "Linode", "GET", recordsPath+"?page_size=100&page="+strconv.Itoa(page), headers, nil, &records)
+		if err != nil {
+			return fmt.Errorf("failed to list DNS records: %w", err)
+		}
+		for i := range records.Data {
+			if records.Data[i].Name == recordName && records.Data[i].Type == recType {
+				existingRecord = &records.Data[i]
+				break
+			}
+		}
+		if page >= records.Pages {
+			break
+		}
+	}
+
+	if existingRecord != nil {
+		// Update existing record
+		record := LinodeRecord{Name: recordName, Target: ip, TTL: ttl}
+		err = apiRequest(ctx, "Linode", "PUT", recordsPath+"/"+strconv.Itoa(existingRecord.ID), headers, record, nil)
+		if err != nil {
+			return fmt.Errorf("failed to update DNS record: %w", err)
+		}
+	} else {
+		// Create new record
+		record := LinodeRecord{Type: recType, Name: recordName, Target: ip, TTL: ttl}
+		err = apiRequest(ctx, "Linode", "POST", recordsPath, headers, record, nil)
+		if err != nil {
+			return fmt.Errorf("failed to create DNS record: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"slices"
+	"testing"
+)
+
+// linodeAPI answers like the linode api for example.com, with records spread over pages of two
+func linodeAPI(records []LinodeRecord) func(w http.ResponseWriter, call apiCall) {
+	return func(w http.ResponseWriter, call apiCall) {
+		switch {
+		case call.method == "GET" && call.path == "/domains":
+			var filter map[string]string
+			json.Unmarshal([]byte(call.header.Get("X-Filter")), &filter)
+			var domains []LinodeDomain
+			if filter["domain"] == "example.com" {
+				domains = append(domains, LinodeDomain{ID: 42, Domain: "example.com"})
+			}
+			json.NewEncoder(w).Encode(map[string]any{"data": domains})
+		case call.method == "GET" && call.path == "/domains/42/records":
+			query, _ := url.ParseQuery(call.query)
+			var page int
+			fmt.Sscan(query.Get("page"), &page)
+			start, end := min((page-1)*2, len(records)), min(page*2, len(records))
+			json.NewEncoder(w).Encode(map[string]any{"data": records[start:end], "page": page, "pages": max((len(records)+1)/2, 1)})
+		default:
+			w.Write([]byte(`{}`))
+		}
+	}
+}
+
+func TestLinodeUpdate(t *testing.T) {
+	records := []LinodeRecord{
+		{ID: 1, Type: "MX", Name: "", Target: "mail.example.com"},
+		{ID: 2, Type: "TXT", Name: "home", Target: "v=spf1 -all"},
+		{ID: 3, Type: "A", Name: "", Target: "192.0.2.10"},
+		{ID: 4, Type: "A", Name: "home", Target: "192.0.2.1"},
+	}
+	tests := []struct {
+		name     string
+		domain   string
+		hostname string
+		ip       string
+		want     []string
+		wantBody LinodeRecord
+		wantErr  string
+	}{
+		{"record on the last page is updated", "example.com", "home.example.com", "192.0.2.2",
+			[]string{"GET /domains", "GET /domains/42/records", "GET /domains/42/records", "PUT /domains/42/records/4"},
+			LinodeRecord{Name: "home", Target: "192.0.2.2", TTL: 300}, ""},
+		{"apex has an empty name", "example.com", "example.com", "192.0.2.3",
+			[]string{"GET /domains", "GET /domains/42/records", "GET /domains/42/records", "PUT /domains/42/records/3"},
+			LinodeRecord{Name: "", Target: "192.0.2.3", TTL: 300}, ""},
+		{"missing record is created after every page", "example.com", "home.example.com", "2001:db8::1",
+			[]string{"GET /domains", "GET /domains/42/records", "GET /domains/42/records", "POST /domains/42/records"},
+			LinodeRecord{Type: "AAAA", Name: "home", Target: "2001:db8::1", TTL: 300}, ""},
+		{"unknown domain", "example.org", "home.example.org", "192.0.2.1",
+			[]string{"GET /domains"}, LinodeRecord{}, dyndnsNoHost},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := startMockAPI(t, &linodeEndpoint, linodeAPI(records))
+			err := linodeDoUpdate(t.Context(), test.domain, "token", test.hostname, test.ip, 300)
+			if test.wantErr != "" {
+				var dyndnsErr *dyndnsError
+				if !errors.As(err, &dyndnsErr) || dyndnsErr.code != test.wantErr {
+					t.Fatalf("err = %v, want %s", err, test.wantErr)
+				}
+			} else if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := mock.requests(); !slices.Equal(got, test.want) {
+				t.Errorf("requests = %v, want %v", got, test.want)
+			}
+			if test.wantErr != "" {
+				return
+			}
+			write := mock.last()
+			if write.header.Get("Authorization") != "Bearer token" {
+				t.Errorf("Authorization = %q", write.header.Get("Authorization"))
+			}
+			var body LinodeRecord
+			json.Unmarshal([]byte(write.body), &body)
+			if body != test.wantBody {
+				t.Errorf("body = %+v, want %+v", body, test.wantBody)
+			}
+		})
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"log/syslog"
 	"net"
 	"net/http"
@@ -18,13 +19,41 @@ func main() {
 	// other wise run a reverse proxy with ssl to provide external access to this questionable app
 	listenIP = net.ParseIP("127.0.0.1")
 	port = 8080
+	if len(os.Args) > 1 && os.Args[1] == "ovh-login" {
+		err := ovhLogin(os.Args[2:])
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "ovh-login failed: "+err.Error())
+			os.Exit(1)
+		}
+		return
+	}
 	parseArgs()
+	err := loadConfig(configFile())
+	if err != nil {
+		logger("failed to start invalid config "+err.Error(), "err")
+		panic("invalid config: " + err.Error())
+	}
+	if config.DNSServer != nil {
+		err = startDNSServer(config.DNSServer)
+		if err != nil {
+			logger("failed to start dns server "+err.Error(), "err")
+			panic("failed to start dns server: " + err.Error())
+		}
+	}
+	if config.Async != nil {
+		err = startQueue(config.Async)
+		if err != nil {
+			logger("failed to start update queue "+err.Error(), "err")
+			panic("failed to start update queue: " + err.Error())
+		}
+	}
 	connectionString := listenIP.String() + ":" + strconv.Itoa(port)
-	http.HandleFunc("/aws/", BasicAuth(awsHandler))
-	http.HandleFunc("/cloudflare/", BasicAuth(cfHandler))
-	http.HandleFunc("/digitalocean/", BasicAuth(doHandler))
-	http.HandleFunc("/azure/", BasicAuth(azureHandler))
-	http.HandleFunc("/ovh/", BasicAuth(ovhHandler))
+	for name := range providers {
+		http.HandleFunc("/"+name+"/", BasicAuth(updateHandler(name)))
+	}
+	http.HandleFunc("/nic/update", BasicAuth(hostHandler))
+	http.HandleFunc("/status", BasicAuth(statusHandler))
+	http.HandleFunc("/metrics", BasicAuth(metricsHandler))
 	http.ListenAndServe(connectionString, nil)
 }
 
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// namecheapEndpoint can be pointed at https://api.sandbox.namecheap.com/xml.response to try
+// things out against the sandbox
+var namecheapEndpoint = "https://api.namecheap.com/xml.response"
+
+// Namecheap host record structure, these are attributes in the getHosts xml response
+type NamecheapHost struct {
+	Name    string `xml:"Name,attr"`
+	Type    string `xml:"Type,attr"`
+	Address string `xml:"Address,attr"`
+	MXPref  string `xml:"MXPref,attr"`
+	TTL     string `xml:"TTL,attr"`
+}
+
+// Namecheap wraps every command result in the same ApiResponse envelope
+type namecheapResponse struct {
+	Status string `xml:"Status,attr"`
+	Errors []struct {
+		Number  string `xml:"Number,attr"`
+		Message string `xml:",chardata"`
+	} `xml:"Errors>Error"`
+	GetHosts struct {
+		EmailType     string          `xml:"EmailType,attr"`
+		IsUsingOurDNS string          `xml:"IsUsingOurDNS,attr"`
+		Hosts         []NamecheapHost `xml:"host"`
+	} `xml:"CommandResponse>DomainDNSGetHostsResult"`
+	SetHosts struct {
+		IsSuccess string `xml:"IsSuccess,attr"`
+	} `xml:"CommandResponse>DomainDNSSetHostsResult"`
+}
+
+func namecheapUpdate(ctx context.Context, settings map[string]string, update *dnsUpdate) error {
+	// api user as username and api key as password, clientip is the whitelisted address this
+	// server calls the namecheap api from
+	for _, ip := range update.primaryIPs() {
+		err := namecheapDoUpdate(ctx, settings["apiuser"], settings["apikey"], settings["clientip"], settings["domain"], update.hostname, ip, update.ttl)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func namecheapDoUpdate(ctx context.Context, apiUser, apiKey, clientIP, domain, hostname, ip string, ttl int) error {
+	subdomain, err := subdomainOf(hostname, domain)
+	if err != nil {
+		return err
+	}
+	if subdomain == "" {
+		subdomain = "@"
+	}
+	fieldType := recordType(ip)
+
+	// namecheap wants the domain split into second level and top level parts ie example + co.uk
+	sld, tld, found := strings.Cut(domain, ".")
+	if !found {
+		return newDyndnsError(dyndnsNoHost, "domain "+domain+" is not a valid namecheap domain")
+	}
+
+	params := url.Values{}
+	params.Set("ApiUser", apiUser)
+	params.Set("ApiKey", apiKey)
+	params.Set("UserName", apiUser)
+	params.Set("ClientIp", clientIP)
+	params.Set("SLD", sld)
+	params.Set("TLD", tld)
+
+	// setHosts replaces every record in the domain, so read the whole list first
+	params.Set("Command", "namecheap.domains.dns.getHosts")
+	current, err := namecheapCall(ctx, params)
+	if err != nil {
+		return fmt.Errorf("failed to list DNS records: %w", err)
+	}
+	if current.GetHosts.IsUsingOurDNS != "true" {
+		return newDyndnsError(dyndnsNoHost, "domain "+domain+" is not using namecheap dns")
+	}
+
+	// only the target entry changes, everything else is written back exactly as it was read
+	hosts := current.GetHosts.Hosts
+	var updated bool
+	for i := range hosts {
+		if strings.EqualFold(hosts[i].Name, subdomain) && hosts[i].Type == fieldType {
+			hosts[i].Address = ip
+			hosts[i].TTL = strconv.Itoa(ttl)
+			updated = true
+			break
+		}
+	}
+	if !updated {
+		hosts = append(hosts, NamecheapHost{Name: subdomain, Type: fieldType, Address: ip, TTL: strconv.Itoa(ttl)})
+	}
+
+	params.Set("Command", "namecheap.domains.dns.setHosts")
+	if current.GetHosts.EmailType != "" {
+		params.Set("EmailType", current.GetHosts.EmailType)
+	}
+	for i, host := range hosts {
+		n := strconv.Itoa(i + 1)
+		params.Set("HostName"+n, host.Name)
+		params.Set("RecordType"+n, host.Type)
+		params.Set("Address"+n, host.Address)
+		params.Set("TTL"+n, host.TTL)
+		if host.MXPref != "" {
+			params.Set("MXPref"+n, host.MXPref)
+		}
+	}
+	result, err := namecheapCall(ctx, params)
+	if err != nil {
+		return fmt.Errorf("failed to update DNS records: %w", err)
+	}
+	if result.SetHosts.IsSuccess != "true" {
+		return errors.New("failed to update DNS records: namecheap did not report success")
+	}
+
+	return nil
+}
+
+// namecheapCall posts a command to the namecheap xml api, POST is used because setHosts can
+// have more parameters than fit in a url
+func namecheapCall(ctx context.Context, params url.Values) (*namecheapResponse, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", namecheapEndpoint, strings.NewReader(params.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := apiHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 400 {
+		return nil, &apiError{provider: "Namecheap", statusCode: resp.StatusCode, body: string(body)}
+	}
+
+	var result namecheapResponse
+	err = xml.Unmarshal(body, &result)
+	if err != nil {
+		return nil, err
+	}
+	if result.Status != "OK" {
+		var messages []string
+		for _, e := range result.Errors {
+			messages = append(messages, e.Number+" "+strings.TrimSpace(e.Message))
+		}
+		return nil, errors.New("Namecheap API error: " + strings.Join(messages, ", "))
+	}
+	return &result, nil
+}
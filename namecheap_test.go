@@ -0,0 +1,193 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// namecheapHosts is the host list of example.com the mock getHosts answers with, everything in
+// it that isn't the target of an update has to be written back exactly
+var namecheapHosts = []NamecheapHost{
+	{Name: "@", Type: "MX", Address: "mail.example.com.", MXPref: "10", TTL: "1800"},
+	{Name: "@", Type: "MX", Address: "backup-mail.example.net.", MXPref: "20", TTL: "1800"},
+	{Name: "@", Type: "TXT", Address: `v=spf1 include:_spf.example.net ~all`, MXPref: "10", TTL: "1799"},
+	{Name: "www", Type: "URL301", Address: "https://example.org/landing?a=1&b=2", MXPref: "10", TTL: "1800"},
+	{Name: "home", Type: "AAAA", Address: "2001:db8::1", MXPref: "10", TTL: "300"},
+	{Name: "home", Type: "A", Address: "192.0.2.1", MXPref: "10", TTL: "300"},
+	{Name: "_dmarc", Type: "TXT", Address: "v=DMARC1; p=none; rua=mailto:dmarc@example.com", MXPref: "10", TTL: "1800"},
+}
+
+// namecheapAPI answers getHosts with hosts and records what setHosts was sent
+func namecheapAPI(hosts []NamecheapHost, usingOurDNS string) func(w http.ResponseWriter, call apiCall) {
+	return func(w http.ResponseWriter, call apiCall) {
+		form, _ := url.ParseQuery(call.body)
+		var result string
+		switch form.Get("Command") {
+		case "namecheap.domains.dns.getHosts":
+			var lines []string
+			for i, host := range hosts {
+				lines = append(lines, fmt.Sprintf(`<host HostId="%d" Name="%s" Type="%s" Address="%s" MXPref="%s" TTL="%s" AssociatedAppTitle="" FriendlyName="" IsActive="true" IsDDNSEnabled="false" />`,
+					i+1, html.EscapeString(host.Name), host.Type, html.EscapeString(host.Address), host.MXPref, host.TTL))
+			}
+			result = `<DomainDNSGetHostsResult Domain="example.com" EmailType="MX" IsUsingOurDNS="` + usingOurDNS + `">` + strings.Join(lines, "\n") + `</DomainDNSGetHostsResult>`
+		case "namecheap.domains.dns.setHosts":
+			result = `<DomainDNSSetHostsResult Domain="example.com" IsSuccess="true" />`
+		}
+		fmt.Fprintf(w, `<?xml version="1.0" encoding="utf-8"?>
+<ApiResponse Status="OK" xmlns="http://api.namecheap.com/xml.response">
+  <Errors />
+  <RequestedCommand>%s</RequestedCommand>
+  <CommandResponse Type="%s">%s</CommandResponse>
+</ApiResponse>`, form.Get("Command"), form.Get("Command"), result)
+	}
+}
+
+// namecheapSetHosts reads the host list back out of a setHosts request
+func namecheapSetHosts(t *testing.T, form url.Values) []NamecheapHost {
+	t.Helper()
+	var hosts []NamecheapHost
+	for n := 1; form.Has("HostName" + strconv.Itoa(n)); n++ {
+		i := strconv.Itoa(n)
+		hosts = append(hosts, NamecheapHost{
+			Name:    form.Get("HostName" + i),
+			Type:    form.Get("RecordType" + i),
+			Address: form.Get("Address" + i),
+			MXPref:  form.Get("MXPref" + i),
+			TTL:     form.Get("TTL" + i),
+		})
+	}
+	// nothing past the last host, a gap would silently drop records
+	for key := range form {
+		for _, prefix := range []string{"HostName", "RecordType", "Address", "MXPref", "TTL"} {
+			if index, found := strings.CutPrefix(key, prefix); found && index != "" {
+				if n, err := strconv.Atoi(index); err != nil || n > len(hosts) {
+					t.Errorf("setHosts has %s beyond the %d hosts", key, len(hosts))
+				}
+			}
+		}
+	}
+	return hosts
+}
+
+func TestNamecheapUpdate(t *testing.T) {
+	tests := []struct {
+		name     string
+		hostname string
+		ip       string
+		// changed is the index of the host that becomes changeTo, or -1 when appended is added on
+		// the end instead
+		changed  int
+		changeTo NamecheapHost
+		appended *NamecheapHost
+	}{
+		{"existing A record changes in place", "home.example.com", "192.0.2.2", 5,
+			NamecheapHost{Name: "home", Type: "A", Address: "192.0.2.2", MXPref: "10", TTL: "600"}, nil},
+		{"existing AAAA record changes in place", "home.example.com", "2001:db8::2", 4,
+			NamecheapHost{Name: "home", Type: "AAAA", Address: "2001:db8::2", MXPref: "10", TTL: "600"}, nil},
+		{"name matches regardless of case", "HOME.example.com", "192.0.2.3", 5,
+			NamecheapHost{Name: "home", Type: "A", Address: "192.0.2.3", MXPref: "10", TTL: "600"}, nil},
+		{"new name is appended", "office.example.com", "192.0.2.4", -1, NamecheapHost{},
+			&NamecheapHost{Name: "office", Type: "A", Address: "192.0.2.4", TTL: "600"}},
+		{"apex A is appended next to the apex MX and TXT", "example.com", "192.0.2.5", -1, NamecheapHost{},
+			&NamecheapHost{Name: "@", Type: "A", Address: "192.0.2.5", TTL: "600"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := startMockAPI(t, &namecheapEndpoint, namecheapAPI(namecheapHosts, "true"))
+			err := namecheapDoUpdate(t.Context(), "apiuser", "apikey", "198.51.100.7", "example.com", test.hostname, test.ip, 600)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			calls := mock.received()
+			if len(calls) != 2 {
+				t.Fatalf("requests = %v, want getHosts then setHosts", mock.requests())
+			}
+			form, _ := url.ParseQuery(calls[1].body)
+			if form.Get("Command") != "namecheap.domains.dns.setHosts" {
+				t.Fatalf("second command = %q", form.Get("Command"))
+			}
+			for key, value := range map[string]string{"ApiUser": "apiuser", "ApiKey": "apikey", "UserName": "apiuser", "ClientIp": "198.51.100.7", "SLD": "example", "TLD": "com", "EmailType": "MX"} {
+				if form.Get(key) != value {
+					t.Errorf("%s = %q, want %q", key, form.Get(key), value)
+				}
+			}
+
+			want := slices.Clone(namecheapHosts)
+			if test.changed >= 0 {
+				want[test.changed] = test.changeTo
+			}
+			if test.appended != nil {
+				want = append(want, *test.appended)
+			}
+			got := namecheapSetHosts(t, form)
+			if len(got) != len(want) {
+				t.Fatalf("setHosts sent %d hosts, want %d:\n%+v", len(got), len(want), got)
+			}
+			for i := range want {
+				if got[i] != want[i] {
+					t.Errorf("host %d = %+v, want %+v", i+1, got[i], want[i])
+				}
+			}
+		})
+	}
+}
+
+func TestNamecheapUpdateRefused(t *testing.T) {
+	tests := []struct {
+		name        string
+		domain      string
+		hostname    string
+		usingOurDNS string
+		wantCalls   int
+	}{
+		{"domain on other name servers is never written", "example.com", "home.example.com", "false", 1},
+		{"hostname outside the domain", "example.com", "home.example.org", "true", 0},
+		{"domain without a tld", "localhost", "home.localhost", "true", 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := startMockAPI(t, &namecheapEndpoint, namecheapAPI(namecheapHosts, test.usingOurDNS))
+			err := namecheapDoUpdate(t.Context(), "apiuser", "apikey", "198.51.100.7", test.domain, test.hostname, "192.0.2.1", 600)
+			if classifyError(err) != errorNotFound {
+				t.Errorf("err = %v, want nohost", err)
+			}
+			if got := mock.requests(); len(got) != test.wantCalls {
+				t.Errorf("requests = %v, want %d", got, test.wantCalls)
+			}
+		})
+	}
+}
+
+func TestNamecheapSecondLevelTLD(t *testing.T) {
+	mock := startMockAPI(t, &namecheapEndpoint, namecheapAPI(nil, "true"))
+	err := namecheapDoUpdate(t.Context(), "apiuser", "apikey", "198.51.100.7", "example.co.uk", "home.example.co.uk", "192.0.2.1", 600)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	form, _ := url.ParseQuery(mock.last().body)
+	if form.Get("SLD") != "example" || form.Get("TLD") != "co.uk" {
+		t.Errorf("SLD, TLD = %q, %q, want example, co.uk", form.Get("SLD"), form.Get("TLD"))
+	}
+	if got := namecheapSetHosts(t, form); len(got) != 1 || got[0].Name != "home" {
+		t.Errorf("setHosts = %+v, want just the new host", got)
+	}
+}
+
+func TestNamecheapAPIError(t *testing.T) {
+	startMockAPI(t, &namecheapEndpoint, func(w http.ResponseWriter, call apiCall) {
+		w.Write([]byte(`<?xml version="1.0" encoding="utf-8"?>
+<ApiResponse Status="ERROR" xmlns="http://api.namecheap.com/xml.response">
+  <Errors><Error Number="1011150">Parameter RequestIP is invalid</Error></Errors>
+</ApiResponse>`))
+	})
+	err := namecheapDoUpdate(t.Context(), "apiuser", "apikey", "198.51.100.7", "example.com", "home.example.com", "192.0.2.1", 600)
+	if err == nil || !strings.Contains(err.Error(), "1011150 Parameter RequestIP is invalid") {
+		t.Errorf("err = %v, want the namecheap error", err)
+	}
+}
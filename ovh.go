@@ -2,12 +2,14 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/url"
 	"strconv"
 	"strings"
 	"time"
@@ -23,163 +25,203 @@ type OVHDNSRecord struct {
 	TTL       int    `json:"ttl,omitempty"`
 }
 
-// OVH API Client structure
+// OVH API Client structure, requests are either signed with an application key, secret and
+// consumer key or carry a bearer token for a service account's client id and secret
 type OVHClient struct {
 	Endpoint          string
 	ApplicationKey    string
 	ApplicationSecret string
 	ConsumerKey       string
+	ClientID          string
+	ClientSecret      string
+	tokenURL          string
 	httpClient        *http.Client
 }
 
-func ovhHandler(w http.ResponseWriter, r *http.Request) {
-	client := r.Header.Get("X-Forwarded-For")
-	if client == "" {
-		client = r.RemoteAddr
-	}
+// ovhToken is a service account's access token and when it stops working
+type ovhToken struct {
+	value   string
+	expires time.Time
+}
 
-	ip, hostname, err := checkForms(r)
+func ovhUpdate(ctx context.Context, settings map[string]string, update *dnsUpdate) error {
+	multi, err := multiValue(settings)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		logger("client: "+client+" "+err.Error(), "err")
-		return
+		return err
 	}
 
-	// URL format: /ovh/endpoint/domain.com/appkey/?ip=x.x.x.x&hostname=host.domain.com
-	pathComponents := strings.Split(r.URL.Path, "/")
-	if len(pathComponents) < 5 || pathComponents[2] == "" || pathComponents[3] == "" || pathComponents[4] == "" {
-		http.Error(w, "invalid path format - expected /ovh/endpoint/domain.com/appkey/", http.StatusBadRequest)
-		logger("client: "+client+" invalid path format", "err")
-		return
+	// Setup OVH API Client
+	ovhClient, err := ovhSetup(settings)
+	if err != nil {
+		return err
 	}
 
-	endpoint := pathComponents[2]
-	domain := pathComponents[3]
-	appKey := pathComponents[4]
-
-	if endpoint == "" || domain == "" || appKey == "" {
-		http.Error(w, "endpoint, domain and application key are required in URL path", http.StatusBadRequest)
-		logger("client: "+client+" missing endpoint, domain or application key in URL path", "err")
-		return
+	// Update DNS record
+	values := managedValues(update, multi)
+	for _, fieldType := range []string{"A", "AAAA"} {
+		if len(values[fieldType]) == 0 {
+			continue
+		}
+		err = ovhUpdateDNS(ctx, ovhClient, settings["domain"], update.hostname, fieldType, values[fieldType], update.ttl, multi)
+		if err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	// Setup OVH API Client
-	ovhClient, err := ovhSetup(appKey, user, pass, endpoint)
+func ovhSetup(settings map[string]string) (*OVHClient, error) {
+	apiEndpoint, err := ovhEndpoint(settings["endpoint"])
 	if err != nil {
-		logger("client: "+client+" "+err.Error(), "err")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return nil, err
+	}
+	client := &OVHClient{
+		Endpoint:   apiEndpoint,
+		httpClient: &http.Client{Timeout: 30 * time.Second},
 	}
 
-	// Add debug logging
-	logger("client: "+client+" OVH request - endpoint: "+endpoint+" domain: "+domain+" appkey: "+appKey+" user: "+user, "info")
-
-	// Update DNS record
-	err = ovhUpdateDNS(ovhClient, domain, hostname, ip)
-	if err != nil {
-		logger("client: "+client+" "+err.Error(), "err")
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+	appKey, appSecret, consumerKey := settings["appkey"], settings["appsecret"], settings["consumerkey"]
+	// a password of appkey:appsecret:consumerkey carries all three so none has to go in the url
+	if strings.Contains(consumerKey, ":") {
+		packed := strings.Split(consumerKey, ":")
+		if len(packed) != 3 {
+			return nil, newDyndnsError(dyndnsBadAuth, "OVH password should be appkey:appsecret:consumerkey")
+		}
+		appKey, appSecret, consumerKey = packed[0], packed[1], packed[2]
 	}
 
-	w.WriteHeader(200)
-	w.Write([]byte("OK\n"))
-	logger("client: "+client+" successfully updated OVH DNS hostname: "+hostname+" ip: "+ip, "info")
-}
+	// without an application key the login is a service account's client id and secret
+	clientID, clientSecret := settings["clientid"], settings["clientsecret"]
+	if clientID == "" && appKey == "" {
+		clientID, clientSecret = appSecret, consumerKey
+	}
+	if clientID != "" {
+		if clientSecret == "" {
+			return nil, errors.New("OVH credentials incomplete - need client id and client secret")
+		}
+		client.tokenURL, err = ovhTokenURL(settings["endpoint"])
+		if err != nil {
+			return nil, err
+		}
+		client.ClientID = clientID
+		client.ClientSecret = clientSecret
+		return client, nil
+	}
 
-func ovhSetup(applicationKey, applicationSecret, consumerKey, endpoint string) (*OVHClient, error) {
-	if applicationKey == "" || applicationSecret == "" || consumerKey == "" {
+	if appKey == "" || appSecret == "" || consumerKey == "" {
 		return nil, errors.New("OVH credentials incomplete - need application key, secret, and consumer key")
 	}
+	client.ApplicationKey = appKey
+	client.ApplicationSecret = appSecret
+	client.ConsumerKey = consumerKey
+	return client, nil
+}
 
-	// Map endpoint names to full URLs
-	var apiEndpoint string
+// ovhEndpoint maps an endpoint name to the api url of that region
+func ovhEndpoint(endpoint string) (string, error) {
 	switch strings.ToLower(endpoint) {
 	case "eu", "europe":
-		apiEndpoint = "https://eu.api.ovh.com/1.0"
+		return "https://eu.api.ovh.com/1.0", nil
 	case "ca", "canada":
-		apiEndpoint = "https://ca.api.ovh.com/1.0"
+		return "https://ca.api.ovh.com/1.0", nil
 	case "us", "usa", "united-states":
-		apiEndpoint = "https://api.ovh.com/1.0"
+		return "https://api.ovh.com/1.0", nil
 	case "au", "australia":
-		apiEndpoint = "https://au.api.ovh.com/1.0"
+		return "https://au.api.ovh.com/1.0", nil
 	default:
-		return nil, errors.New("unsupported OVH endpoint - supported: eu, ca, us, au")
+		return "", errors.New("unsupported OVH endpoint - supported: eu, ca, us, au")
 	}
+}
 
-	client := &OVHClient{
-		Endpoint:          apiEndpoint,
-		ApplicationKey:    applicationKey,
-		ApplicationSecret: applicationSecret,
-		ConsumerKey:       consumerKey,
-		httpClient:        &http.Client{Timeout: 30 * time.Second},
+// ovhTokenURL maps an endpoint name to where service accounts get their access tokens
+func ovhTokenURL(endpoint string) (string, error) {
+	switch strings.ToLower(endpoint) {
+	case "eu", "europe":
+		return "https://www.ovh.com/auth/oauth2/token", nil
+	case "ca", "canada":
+		return "https://ca.ovh.com/auth/oauth2/token", nil
+	case "us", "usa", "united-states":
+		return "https://us.ovhcloud.com/auth/oauth2/token", nil
+	default:
+		return "", errors.New("OVH service accounts are only supported on the eu, ca and us endpoints")
 	}
-
-	return client, nil
 }
 
-func ovhUpdateDNS(client *OVHClient, domain, hostname, ip string) error {
+func ovhUpdateDNS(ctx context.Context, client *OVHClient, domain, hostname, fieldType string, ips []string, ttl int, multi bool) error {
 	// Extract subdomain from hostname
-	subdomain := ""
-	if hostname != domain {
-		if strings.HasSuffix(hostname, "."+domain) {
-			subdomain = strings.TrimSuffix(hostname, "."+domain)
-		} else {
-			return errors.New("hostname does not match domain")
-		}
+	subdomain, err := subdomainOf(hostname, domain)
+	if err != nil {
+		return err
 	}
 
-	// List existing A records for this subdomain
-	records, err := client.listDNSRecords(domain, subdomain, "A")
+	// List existing records of this type for this subdomain
+	records, err := client.listDNSRecords(ctx, domain, subdomain, fieldType)
 	if err != nil {
-		return errors.New("failed to list DNS records: " + err.Error())
+		return fmt.Errorf("failed to list DNS records: %w", err)
 	}
 
-	// If record exists, update it; otherwise create new one
-	if len(records) > 0 {
-		// Update existing record
-		recordID := records[0]
-		err = client.updateDNSRecord(domain, recordID, ip)
+	// the listing only has ids, the targets are only needed to match them up when converging
+	existing := make([]string, len(records))
+	if !multi {
+		for i, recordID := range records {
+			record, err := client.getDNSRecord(ctx, domain, recordID)
+			if err != nil {
+				return fmt.Errorf("failed to get DNS record: %w", err)
+			}
+			existing[i] = record.Target
+		}
+	}
+
+	// records are updated and created before the extras are deleted so the name always resolves
+	plan := planRecords(existing, ips, multi)
+	for _, change := range plan.update {
+		err = client.updateDNSRecord(ctx, domain, records[change.index], change.value, ttl)
 		if err != nil {
-			return errors.New("failed to update DNS record: " + err.Error())
+			return fmt.Errorf("failed to update DNS record: %w", err)
 		}
-	} else {
-		// Create new record
+	}
+	for _, ip := range plan.create {
 		record := OVHDNSRecord{
 			SubDomain: subdomain,
-			FieldType: "A",
+			FieldType: fieldType,
 			Target:    ip,
-			TTL:       300,
+			TTL:       ttl,
+		}
+		_, err = client.createDNSRecord(ctx, domain, record)
+		if err != nil {
+			return fmt.Errorf("failed to create DNS record: %w", err)
 		}
-		_, err = client.createDNSRecord(domain, record)
+	}
+	for _, index := range plan.remove {
+		err = client.deleteDNSRecord(ctx, domain, records[index])
 		if err != nil {
-			return errors.New("failed to create DNS record: " + err.Error())
+			return fmt.Errorf("failed to delete duplicate DNS record: %w", err)
 		}
 	}
 
 	// Refresh the zone to apply changes
-	err = client.refreshZone(domain)
+	err = client.refreshZone(ctx, domain)
 	if err != nil {
-		return errors.New("failed to refresh DNS zone: " + err.Error())
+		return fmt.Errorf("failed to refresh DNS zone: %w", err)
 	}
 
 	return nil
 }
 
 // OVH API helper methods
-func (c *OVHClient) listDNSRecords(domain, subdomain, fieldType string) ([]int64, error) {
-	path := fmt.Sprintf("/domain/zone/%s/record", domain)
+func (c *OVHClient) listDNSRecords(ctx context.Context, domain, subdomain, fieldType string) ([]int64, error) {
+	path := "/domain/zone/" + url.PathEscape(domain) + "/record"
 
 	// Build query parameters
-	params := make(map[string]string)
+	params := url.Values{}
 	if subdomain != "" {
-		params["subDomain"] = subdomain
+		params.Set("subDomain", subdomain)
 	}
 	if fieldType != "" {
-		params["fieldType"] = fieldType
+		params.Set("fieldType", fieldType)
 	}
 
-	body, err := c.makeRequest("GET", path, params, nil)
+	body, err := c.makeRequest(ctx, "GET", path, params, nil)
 	if err != nil {
 		return nil, err
 	}
@@ -193,15 +235,32 @@ func (c *OVHClient) listDNSRecords(domain, subdomain, fieldType string) ([]int64
 	return records, nil
 }
 
-func (c *OVHClient) createDNSRecord(domain string, record OVHDNSRecord) (int64, error) {
-	path := fmt.Sprintf("/domain/zone/%s/record", domain)
+func (c *OVHClient) getDNSRecord(ctx context.Context, domain string, recordID int64) (*OVHDNSRecord, error) {
+	path := "/domain/zone/" + url.PathEscape(domain) + "/record/" + strconv.FormatInt(recordID, 10)
+
+	body, err := c.makeRequest(ctx, "GET", path, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	var record OVHDNSRecord
+	err = json.Unmarshal(body, &record)
+	if err != nil {
+		return nil, err
+	}
+
+	return &record, nil
+}
+
+func (c *OVHClient) createDNSRecord(ctx context.Context, domain string, record OVHDNSRecord) (int64, error) {
+	path := "/domain/zone/" + url.PathEscape(domain) + "/record"
 
 	jsonData, err := json.Marshal(record)
 	if err != nil {
 		return 0, err
 	}
 
-	body, err := c.makeRequest("POST", path, nil, jsonData)
+	body, err := c.makeRequest(ctx, "POST", path, nil, jsonData)
 	if err != nil {
 		return 0, err
 	}
@@ -217,12 +276,12 @@ func (c *OVHClient) createDNSRecord(domain string, record OVHDNSRecord) (int64,
 	return result.ID, nil
 }
 
-func (c *OVHClient) updateDNSRecord(domain string, recordID int64, target string) error {
-	path := fmt.Sprintf("/domain/zone/%s/record/%d", domain, recordID)
+func (c *OVHClient) updateDNSRecord(ctx context.Context, domain string, recordID int64, target string, ttl int) error {
+	path := "/domain/zone/" + url.PathEscape(domain) + "/record/" + strconv.FormatInt(recordID, 10)
 
 	updateData := map[string]interface{}{
 		"target": target,
-		"ttl":    300,
+		"ttl":    ttl,
 	}
 
 	jsonData, err := json.Marshal(updateData)
@@ -230,58 +289,78 @@ func (c *OVHClient) updateDNSRecord(domain string, recordID int64, target string
 		return err
 	}
 
-	_, err = c.makeRequest("PUT", path, nil, jsonData)
+	_, err = c.makeRequest(ctx, "PUT", path, nil, jsonData)
+	return err
+}
+
+func (c *OVHClient) deleteDNSRecord(ctx context.Context, domain string, recordID int64) error {
+	path := "/domain/zone/" + url.PathEscape(domain) + "/record/" + strconv.FormatInt(recordID, 10)
+	_, err := c.makeRequest(ctx, "DELETE", path, nil, nil)
 	return err
 }
 
-func (c *OVHClient) refreshZone(domain string) error {
-	path := fmt.Sprintf("/domain/zone/%s/refresh", domain)
-	_, err := c.makeRequest("POST", path, nil, nil)
+func (c *OVHClient) refreshZone(ctx context.Context, domain string) error {
+	path := "/domain/zone/" + url.PathEscape(domain) + "/refresh"
+	_, err := c.makeRequest(ctx, "POST", path, nil, nil)
 	return err
 }
 
-func (c *OVHClient) makeRequest(method, path string, params map[string]string, body []byte) ([]byte, error) {
-	// Build URL with query parameters
-	url := c.Endpoint + path
+func (c *OVHClient) makeRequest(ctx context.Context, method, path string, params url.Values, body []byte) ([]byte, error) {
+	// Build URL with query parameters, the signature covers the url exactly as it is sent so the
+	// parameters are escaped before signing
+	requestURL := c.Endpoint + path
 	if len(params) > 0 {
-		url += "?"
-		for k, v := range params {
-			url += k + "=" + v + "&"
-		}
-		url = strings.TrimSuffix(url, "&")
+		requestURL += "?" + params.Encode()
 	}
 
 	// Create request
 	var req *http.Request
 	var err error
 	if body != nil {
-		req, err = http.NewRequest(method, url, bytes.NewBuffer(body))
+		req, err = http.NewRequestWithContext(ctx, method, requestURL, bytes.NewBuffer(body))
 		if err != nil {
 			return nil, err
 		}
 		req.Header.Set("Content-Type", "application/json")
 	} else {
-		req, err = http.NewRequest(method, url, nil)
+		req, err = http.NewRequestWithContext(ctx, method, requestURL, nil)
 		if err != nil {
 			return nil, err
 		}
 	}
 
-	// Add OVH API authentication headers
-	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
-
-	// Create signature
-	bodyStr := ""
-	if body != nil {
-		bodyStr = string(body)
+	// Add OVH API authentication headers, service accounts send a bearer token, the rest sign the
+	// request, requests made before there is a consumer key, ie asking for one, are sent with just
+	// the application key
+	if c.ClientID != "" {
+		token, err := c.accessToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	} else {
+		req.Header.Set("X-Ovh-Application", c.ApplicationKey)
 	}
+	if c.ClientID == "" && c.ConsumerKey != "" {
+		// OVH refuses signatures more than a few seconds off its own clock
+		now, err := ovhServerTime(ctx, c.Endpoint)
+		if err != nil {
+			return nil, err
+		}
+		timestamp := strconv.FormatInt(now.Unix(), 10)
 
-	signature := c.createSignature(method, url, bodyStr, timestamp)
+		// Create signature
+		bodyStr := ""
+		if body != nil {
+			bodyStr = string(body)
+		}
+
+		signature := c.createSignature(method, requestURL, bodyStr, timestamp)
 
-	req.Header.Set("X-Ovh-Application", c.ApplicationKey)
-	req.Header.Set("X-Ovh-Consumer", c.ConsumerKey)
-	req.Header.Set("X-Ovh-Timestamp", timestamp)
-	req.Header.Set("X-Ovh-Signature", signature)
+		req.Header.Set("X-Ovh-Consumer", c.ConsumerKey)
+		req.Header.Set("X-Ovh-Timestamp", timestamp)
+		req.Header.Set("X-Ovh-Signature", signature)
+	}
 
 	// Make request
 	resp, err := c.httpClient.Do(req)
@@ -296,12 +375,101 @@ func (c *OVHClient) makeRequest(method, path string, params map[string]string, b
 	}
 
 	if resp.StatusCode >= 400 {
-		return nil, errors.New(fmt.Sprintf("OVH API error %d: %s", resp.StatusCode, string(respBody)))
+		// a revoked token is fetched again on the next request rather than reused until it expires
+		if resp.StatusCode == http.StatusUnauthorized && c.ClientID != "" {
+			forgetCached(c.tokenKey())
+		}
+		return nil, &apiError{
+			provider:   "OVH",
+			statusCode: resp.StatusCode,
+			body:       string(respBody),
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
 	}
 
 	return respBody, nil
 }
 
+// tokenKey is the cache key of the service account's access token
+func (c *OVHClient) tokenKey() string {
+	return cacheKey("ovh-token", c.tokenURL, c.ClientID, c.ClientSecret)
+}
+
+// accessToken returns a cached access token for the service account, or gets a new one with the
+// client credentials grant when there isn't one or it's about to expire
+func (c *OVHClient) accessToken(ctx context.Context) (string, error) {
+	fetch := func() (ovhToken, error) {
+		return c.fetchToken(ctx)
+	}
+	token, err := cached(c.tokenKey(), clientCacheTTL, fetch)
+	if err == nil && time.Until(token.expires) < time.Minute {
+		forgetCached(c.tokenKey())
+		token, err = cached(c.tokenKey(), clientCacheTTL, fetch)
+	}
+	return token.value, err
+}
+
+func (c *OVHClient) fetchToken(ctx context.Context) (ovhToken, error) {
+	form := url.Values{}
+	form.Set("grant_type", "client_credentials")
+	form.Set("client_id", c.ClientID)
+	form.Set("client_secret", c.ClientSecret)
+	form.Set("scope", "all")
+	req, err := http.NewRequestWithContext(ctx, "POST", c.tokenURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return ovhToken{}, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return ovhToken{}, err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ovhToken{}, err
+	}
+	if resp.StatusCode >= 400 {
+		return ovhToken{}, &apiError{
+			provider:   "OVH",
+			statusCode: resp.StatusCode,
+			body:       string(respBody),
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+
+	var result struct {
+		AccessToken string `json:"access_token"`
+		ExpiresIn   int    `json:"expires_in"`
+	}
+	err = json.Unmarshal(respBody, &result)
+	if err != nil {
+		return ovhToken{}, err
+	}
+	if result.AccessToken == "" {
+		return ovhToken{}, errors.New("OVH did not return an access token")
+	}
+	return ovhToken{value: result.AccessToken, expires: time.Now().Add(time.Duration(result.ExpiresIn) * time.Second)}, nil
+}
+
+// ovhServerTime returns the time by OVH's clock, the difference to the local clock is fetched from
+// /auth/time once per endpoint and cached like a client
+func ovhServerTime(ctx context.Context, endpoint string) (time.Time, error) {
+	delta, err := cached(cacheKey("ovh-time", endpoint), clientCacheTTL, func() (time.Duration, error) {
+		var serverTime int64
+		err := apiRequest(ctx, "OVH", "GET", endpoint+"/auth/time", nil, nil, &serverTime)
+		if err != nil {
+			return 0, fmt.Errorf("failed to get OVH server time: %w", err)
+		}
+		return time.Until(time.Unix(serverTime, 0)), nil
+	})
+	if err != nil {
+		return time.Time{}, err
+	}
+	return time.Now().Add(delta), nil
+}
+
 func (c *OVHClient) createSignature(method, url, body, timestamp string) string {
 	// OVH signature format: $1$<sha1_hex>
 	toSign := c.ApplicationSecret + "+" + c.ConsumerKey + "+" + method + "+" + url + "+" + body + "+" + timestamp
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestOVHConverge(t *testing.T) {
+	records := map[string]string{"1": "192.0.2.1", "2": "192.0.2.9", "3": "192.0.2.1"}
+	tests := []struct {
+		name     string
+		ips      []string
+		multi    bool
+		want     []string
+		wantBody map[string]string
+	}{
+		{"duplicate and stale records", []string{"192.0.2.1", "192.0.2.2"}, false, []string{
+			"GET /domain/zone/example.com/record",
+			"GET /domain/zone/example.com/record/1",
+			"GET /domain/zone/example.com/record/2",
+			"GET /domain/zone/example.com/record/3",
+			"PUT /domain/zone/example.com/record/1",
+			"PUT /domain/zone/example.com/record/2",
+			"DELETE /domain/zone/example.com/record/3",
+			"POST /domain/zone/example.com/refresh",
+		}, map[string]string{"1": "192.0.2.1", "2": "192.0.2.2"}},
+		// the targets aren't even read when only the first record is touched
+		{"multi leaves the extras alone", []string{"192.0.2.2"}, true, []string{
+			"GET /domain/zone/example.com/record",
+			"PUT /domain/zone/example.com/record/1",
+			"POST /domain/zone/example.com/refresh",
+		}, map[string]string{"1": "192.0.2.2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var endpoint string
+			mock := startMockAPI(t, &endpoint, func(w http.ResponseWriter, call apiCall) {
+				id := call.path[strings.LastIndex(call.path, "/")+1:]
+				switch {
+				case call.method == "GET" && id == "record":
+					w.Write([]byte(`[1,2,3]`))
+				case call.method == "GET":
+					json.NewEncoder(w).Encode(OVHDNSRecord{SubDomain: "home", FieldType: "A", Target: records[id], TTL: 300})
+				default:
+					w.Write([]byte(`null`))
+				}
+			})
+			client := &OVHClient{Endpoint: endpoint, ApplicationKey: "appkey", httpClient: http.DefaultClient}
+			err := ovhUpdateDNS(t.Context(), client, "example.com", "home.example.com", "A", test.ips, 300, test.multi)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := mock.requests(); !slices.Equal(got, test.want) {
+				t.Errorf("requests = %v, want %v", got, test.want)
+			}
+			for _, call := range mock.received() {
+				if call.method != "PUT" {
+					continue
+				}
+				var record OVHDNSRecord
+				json.Unmarshal([]byte(call.body), &record)
+				id := call.path[strings.LastIndex(call.path, "/")+1:]
+				if record.Target != test.wantBody[id] {
+					t.Errorf("record %s target = %q, want %q", id, record.Target, test.wantBody[id])
+				}
+			}
+		})
+	}
+}
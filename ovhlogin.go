@@ -0,0 +1,204 @@
+package main
+
+// This file is the ovh-login command, it asks OVH for a consumer key that can only reach the dns
+// zone calls, prints the url to validate it at and stores it with the application key and secret
+// in the server config so routers only send a client username and password
+//
+//	cloud-ddns ovh-login -client home-router -endpoint eu -domain example.com
+//
+// the application key and secret are read from -appkey and -appsecret or the OVH_APPLICATION_KEY
+// and OVH_APPLICATION_SECRET env vars, so the secret doesn't have to show up in the process list
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// ovhCredential is what /auth/credential answers with
+type ovhCredential struct {
+	ValidationURL string `json:"validationUrl"`
+	ConsumerKey   string `json:"consumerKey"`
+	State         string `json:"state"`
+}
+
+func ovhLogin(args []string) error {
+	flags := flag.NewFlagSet("ovh-login", flag.ContinueOnError)
+	client := flags.String("client", "", "client in the server config to store the credentials for")
+	endpoint := flags.String("endpoint", "eu", "OVH api endpoint, eu, ca, us or au")
+	domain := flags.String("domain", "", "zone to limit the consumer key to, every zone when empty")
+	appKey := flags.String("appkey", os.Getenv("OVH_APPLICATION_KEY"), "OVH application key")
+	appSecret := flags.String("appsecret", os.Getenv("OVH_APPLICATION_SECRET"), "OVH application secret")
+	err := flags.Parse(args)
+	if err != nil {
+		return err
+	}
+	if *client == "" || *appKey == "" || *appSecret == "" {
+		return errors.New("-client, -appkey and -appsecret are required")
+	}
+
+	// check the config loads and has the client before asking for a key to store in it
+	path := configFile()
+	err = loadConfig(path)
+	if err != nil {
+		return err
+	}
+	if config.Clients[*client] == nil {
+		return errors.New("client " + *client + " is not in " + path + ", add it with a password first")
+	}
+
+	apiEndpoint, err := ovhEndpoint(*endpoint)
+	if err != nil {
+		return err
+	}
+	ovhClient := &OVHClient{
+		Endpoint:          apiEndpoint,
+		ApplicationKey:    *appKey,
+		ApplicationSecret: *appSecret,
+		httpClient:        &http.Client{Timeout: 30 * time.Second},
+	}
+
+	ctx := context.Background()
+	credential, err := ovhRequestCredential(ctx, ovhClient, *domain)
+	if err != nil {
+		return err
+	}
+	fmt.Println("Log in to OVH and validate the consumer key at:")
+	fmt.Println()
+	fmt.Println("  " + credential.ValidationURL)
+	fmt.Println()
+	fmt.Print("then press enter to continue ")
+	_, err = bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return err
+	}
+
+	// the key only works once it's been validated, check it does before storing it
+	ovhClient.ConsumerKey = credential.ConsumerKey
+	var current struct {
+		Status string `json:"status"`
+	}
+	body, err := ovhClient.makeRequest(ctx, "GET", "/auth/currentCredential", nil, nil)
+	if err != nil {
+		return fmt.Errorf("consumer key was not validated: %w", err)
+	}
+	err = json.Unmarshal(body, &current)
+	if err != nil {
+		return err
+	}
+	if current.Status != "validated" {
+		return errors.New("consumer key is " + current.Status + ", it was not validated")
+	}
+
+	settings := map[string]string{
+		"endpoint":    *endpoint,
+		"appkey":      *appKey,
+		"appsecret":   *appSecret,
+		"consumerkey": credential.ConsumerKey,
+	}
+	if *domain != "" {
+		settings["domain"] = *domain
+	}
+	err = storeClientSettings(path, *client, "ovh", settings)
+	if err != nil {
+		return err
+	}
+	fmt.Println("consumer key stored in " + path + " for client " + *client)
+	return nil
+}
+
+// ovhRequestCredential asks for a consumer key allowed to read and change records in domain, or in
+// every zone when domain is empty, and nothing else
+func ovhRequestCredential(ctx context.Context, client *OVHClient, domain string) (*ovhCredential, error) {
+	zonePath := "/domain/zone/*"
+	if domain != "" {
+		zonePath = "/domain/zone/" + domain + "/*"
+	}
+	type accessRule struct {
+		Method string `json:"method"`
+		Path   string `json:"path"`
+	}
+	var request struct {
+		AccessRules []accessRule `json:"accessRules"`
+	}
+	for _, method := range []string{"GET", "POST", "PUT", "DELETE"} {
+		request.AccessRules = append(request.AccessRules, accessRule{Method: method, Path: zonePath})
+	}
+	jsonData, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// there's no consumer key yet so this request is sent unsigned
+	body, err := client.makeRequest(ctx, "POST", "/auth/credential", nil, jsonData)
+	if err != nil {
+		return nil, fmt.Errorf("failed to request OVH consumer key: %w", err)
+	}
+	var credential ovhCredential
+	err = json.Unmarshal(body, &credential)
+	if err != nil {
+		return nil, err
+	}
+	if credential.ConsumerKey == "" || credential.ValidationURL == "" {
+		return nil, errors.New("OVH did not return a consumer key")
+	}
+	return &credential, nil
+}
+
+// storeClientSettings sets the settings of a client's provider in the config file, leaving the
+// rest of the file as it was apart from formatting
+func storeClientSettings(path, client, provider string, settings map[string]string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var raw map[string]json.RawMessage
+	err = json.Unmarshal(data, &raw)
+	if err != nil {
+		return err
+	}
+	var clients map[string]map[string]json.RawMessage
+	err = json.Unmarshal(raw["clients"], &clients)
+	if err != nil {
+		return err
+	}
+	var clientProviders map[string]map[string]string
+	if rawProviders, found := clients[client]["providers"]; found {
+		err = json.Unmarshal(rawProviders, &clientProviders)
+		if err != nil {
+			return err
+		}
+	}
+	if clientProviders == nil {
+		clientProviders = make(map[string]map[string]string)
+	}
+	if clientProviders[provider] == nil {
+		clientProviders[provider] = make(map[string]string)
+	}
+	for key, value := range settings {
+		clientProviders[provider][key] = value
+	}
+
+	clients[client]["providers"], err = json.Marshal(clientProviders)
+	if err != nil {
+		return err
+	}
+	raw["clients"], err = json.Marshal(clients)
+	if err != nil {
+		return err
+	}
+	data, err = json.MarshalIndent(raw, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// a failed write can't leave the config half written, and it keeps its mode and owner as the
+	// service usually runs as its own user and has to be able to read it
+	return writeFileAtomic(path, append(data, '\n'), 0600)
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestStoreClientSettings(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.json")
+	original := `{"clients":{"router":{"password":"p","providers":{"linode":{"token":"x"},"ovh":{"domain":"example.com","consumerkey":"old"}}}},"retry":{"attempts":3}}`
+	err := os.WriteFile(path, []byte(original), 0o640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a config owned by root and readable by the service's group has to stay that way
+	owned := os.Geteuid() == 0
+	if owned {
+		err = os.Chown(path, 0, 4321)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = storeClientSettings(path, "router", "ovh", map[string]string{"consumerkey": "new", "appkey": "AK"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Errorf("mode = %v, want 0640", info.Mode().Perm())
+	}
+	if stat := info.Sys().(*syscall.Stat_t); owned && (stat.Uid != 0 || stat.Gid != 4321) {
+		t.Errorf("owner = %d:%d, want 0:4321", stat.Uid, stat.Gid)
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stored struct {
+		Clients map[string]*ClientConfig `json:"clients"`
+		Retry   *RetryConfig             `json:"retry"`
+	}
+	err = json.Unmarshal(data, &stored)
+	if err != nil {
+		t.Fatal(err)
+	}
+	providers := stored.Clients["router"].Providers
+	if providers["ovh"]["consumerkey"] != "new" || providers["ovh"]["appkey"] != "AK" || providers["ovh"]["domain"] != "example.com" {
+		t.Errorf("ovh settings = %v", providers["ovh"])
+	}
+	if providers["linode"]["token"] != "x" || stored.Clients["router"].Password != "p" || stored.Retry == nil {
+		t.Errorf("rest of the config changed: %s", data)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("temp file left behind, directory has %d entries", len(entries))
+	}
+}
@@ -0,0 +1,115 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+)
+
+var porkbunEndpoint = "https://api.porkbun.com/api/json/v3"
+
+// Porkbun rejects anything lower than this
+const porkbunMinTTL = 600
+
+// Porkbun DNS Record structure
+type PorkbunRecord struct {
+	ID      string `json:"id"`
+	Name    string `json:"name"`
+	Type    string `json:"type"`
+	Content string `json:"content"`
+	TTL     string `json:"ttl"`
+}
+
+// Porkbun sends its credentials in the body of every request rather than in headers
+type porkbunRequest struct {
+	APIKey       string `json:"apikey"`
+	SecretAPIKey string `json:"secretapikey"`
+	Name         string `json:"name,omitempty"`
+	Type         string `json:"type,omitempty"`
+	Content      string `json:"content,omitempty"`
+	TTL          string `json:"ttl,omitempty"`
+}
+
+type porkbunResponse struct {
+	Status  string          `json:"status"`
+	Message string          `json:"message"`
+	Records []PorkbunRecord `json:"records"`
+}
+
+func porkbunUpdate(ctx context.Context, settings map[string]string, update *dnsUpdate) error {
+	// api key as username and secret api key as password, domain comes from the url
+	for _, ip := range update.primaryIPs() {
+		err := porkbunDoUpdate(ctx, settings["apikey"], settings["secretapikey"], settings["domain"], update.hostname, ip, update.ttl)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func porkbunDoUpdate(ctx context.Context, apiKey, secretAPIKey, domain, hostname, ip string, ttl int) error {
+	subdomain, err := subdomainOf(hostname, domain)
+	if err != nil {
+		return err
+	}
+	fieldType := recordType(ip)
+
+	if ttl < porkbunMinTTL {
+		ttl = porkbunMinTTL
+	}
+
+	// the ByNameType calls take the subdomain as the last path element, leaving it off means the apex
+	nameType := url.PathEscape(domain) + "/" + fieldType
+	if subdomain != "" {
+		nameType += "/" + url.PathEscape(subdomain)
+	}
+
+	// Check if DNS Record exists
+	existing, err := porkbunCall(ctx, "/dns/retrieveByNameType/"+nameType, porkbunRequest{APIKey: apiKey, SecretAPIKey: secretAPIKey})
+	if err != nil {
+		return fmt.Errorf("failed to list DNS records: %w", err)
+	}
+
+	if len(existing.Records) > 0 {
+		// Update existing record
+		_, err = porkbunCall(ctx, "/dns/editByNameType/"+nameType, porkbunRequest{
+			APIKey:       apiKey,
+			SecretAPIKey: secretAPIKey,
+			Content:      ip,
+			TTL:          strconv.Itoa(ttl),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to update DNS record: %w", err)
+		}
+	} else {
+		// Create new record
+		_, err = porkbunCall(ctx, "/dns/create/"+url.PathEscape(domain), porkbunRequest{
+			APIKey:       apiKey,
+			SecretAPIKey: secretAPIKey,
+			Name:         subdomain,
+			Type:         fieldType,
+			Content:      ip,
+			TTL:          strconv.Itoa(ttl),
+		})
+		if err != nil {
+			return fmt.Errorf("failed to create DNS record: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// porkbunCall posts to the porkbun api, which reports failures in the status field as well as the status code
+func porkbunCall(ctx context.Context, path string, body porkbunRequest) (*porkbunResponse, error) {
+	var result porkbunResponse
+	err := apiRequest(ctx, "Porkbun", "POST", porkbunEndpoint+path, nil, body, &result)
+	if err != nil {
+		return nil, err
+	}
+	if result.Status != "SUCCESS" {
+		return nil, errors.New("Porkbun API error: " + result.Message)
+	}
+	return &result, nil
+}
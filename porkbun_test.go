@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// porkbunAPI answers retrieveByNameType with the records of example.com matching the name and type
+// in the path and every other call with success
+func porkbunAPI(records []PorkbunRecord) func(w http.ResponseWriter, call apiCall) {
+	return func(w http.ResponseWriter, call apiCall) {
+		response := porkbunResponse{Status: "SUCCESS"}
+		if nameType, found := strings.CutPrefix(call.path, "/dns/retrieveByNameType/example.com/"); found {
+			fieldType, subdomain, _ := strings.Cut(nameType, "/")
+			name := "example.com"
+			if subdomain != "" {
+				name = subdomain + ".example.com"
+			}
+			for _, record := range records {
+				if record.Name == name && record.Type == fieldType {
+					response.Records = append(response.Records, record)
+				}
+			}
+		}
+		json.NewEncoder(w).Encode(response)
+	}
+}
+
+func TestPorkbunUpdate(t *testing.T) {
+	records := []PorkbunRecord{
+		{ID: "1", Name: "example.com", Type: "MX", Content: "mail.example.com", TTL: "600"},
+		{ID: "2", Name: "home.example.com", Type: "TXT", Content: "v=spf1 -all", TTL: "600"},
+		{ID: "3", Name: "home.example.com", Type: "A", Content: "192.0.2.1", TTL: "600"},
+		{ID: "4", Name: "example.com", Type: "A", Content: "192.0.2.10", TTL: "600"},
+	}
+	tests := []struct {
+		name     string
+		hostname string
+		ip       string
+		ttl      int
+		want     []string
+		wantBody porkbunRequest
+	}{
+		{"existing record is edited", "home.example.com", "192.0.2.2", 900,
+			[]string{"POST /dns/retrieveByNameType/example.com/A/home", "POST /dns/editByNameType/example.com/A/home"},
+			porkbunRequest{APIKey: "pk1", SecretAPIKey: "sk1", Content: "192.0.2.2", TTL: "900"}},
+		{"apex leaves the subdomain off the path", "example.com", "192.0.2.3", 900,
+			[]string{"POST /dns/retrieveByNameType/example.com/A", "POST /dns/editByNameType/example.com/A"},
+			porkbunRequest{APIKey: "pk1", SecretAPIKey: "sk1", Content: "192.0.2.3", TTL: "900"}},
+		{"other type on the name is left alone and a record created", "home.example.com", "2001:db8::1", 900,
+			[]string{"POST /dns/retrieveByNameType/example.com/AAAA/home", "POST /dns/create/example.com"},
+			porkbunRequest{APIKey: "pk1", SecretAPIKey: "sk1", Name: "home", Type: "AAAA", Content: "2001:db8::1", TTL: "900"}},
+		{"ttl raised to the minimum", "new.example.com", "192.0.2.4", 60,
+			[]string{"POST /dns/retrieveByNameType/example.com/A/new", "POST /dns/create/example.com"},
+			porkbunRequest{APIKey: "pk1", SecretAPIKey: "sk1", Name: "new", Type: "A", Content: "192.0.2.4", TTL: "600"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			mock := startMockAPI(t, &porkbunEndpoint, porkbunAPI(records))
+			err := porkbunDoUpdate(t.Context(), "pk1", "sk1", "example.com", test.hostname, test.ip, test.ttl)
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if got := mock.requests(); !slices.Equal(got, test.want) {
+				t.Errorf("requests = %v, want %v", got, test.want)
+			}
+			calls := mock.received()
+			var lookup, write porkbunRequest
+			json.Unmarshal([]byte(calls[0].body), &lookup)
+			json.Unmarshal([]byte(calls[len(calls)-1].body), &write)
+			if lookup != (porkbunRequest{APIKey: "pk1", SecretAPIKey: "sk1"}) {
+				t.Errorf("lookup body = %+v, want just the credentials", lookup)
+			}
+			if write != test.wantBody {
+				t.Errorf("write body = %+v, want %+v", write, test.wantBody)
+			}
+		})
+	}
+}
+
+func TestPorkbunAPIError(t *testing.T) {
+	mock := startMockAPI(t, &porkbunEndpoint, func(w http.ResponseWriter, call apiCall) {
+		json.NewEncoder(w).Encode(porkbunResponse{Status: "ERROR", Message: "Domain is not opted in to API access."})
+	})
+	err := porkbunDoUpdate(t.Context(), "pk1", "sk1", "example.com", "home.example.com", "192.0.2.1", 600)
+	if err == nil || !strings.Contains(err.Error(), "Domain is not opted in to API access.") {
+		t.Errorf("err = %v, want the porkbun message", err)
+	}
+	// a failed lookup must not fall through to creating a duplicate
+	if got := mock.requests(); len(got) != 1 {
+		t.Errorf("requests = %v, want only the lookup", got)
+	}
+}
@@ -0,0 +1,369 @@
+package main
+
+// This file contains async mode, requests are checked, written to a queue file on disk and answered
+// with good straight away, then workers apply them in the background and retry failures for far
+// longer than a router would wait. Only the latest update for a hostname is kept, an older one
+// still waiting in the queue is replaced by a newer one.
+
+import (
+	"cmp"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	defaultQueueFile     = "/var/lib/cloud-ddns/queue.json"
+	defaultQueueWorkers  = 2
+	defaultQueueAttempts = 10
+	defaultQueueWait     = 30 * time.Second
+	defaultQueueMaxWait  = 10 * time.Minute
+)
+
+// AsyncConfig is the "async" section of the config, async mode is on when it's set
+type AsyncConfig struct {
+	// QueueFile holds the pending updates and their settings, it's written with 0600 permissions
+	QueueFile string `json:"queueFile"`
+	Workers   int    `json:"workers"`
+	// Attempts is how many times a queued update is tried before it's dropped
+	Attempts int `json:"attempts"`
+	// Wait is a go duration like "30s", the wait before the first retry which doubles up to MaxWait
+	Wait    string `json:"wait"`
+	MaxWait string `json:"maxWait"`
+
+	wait, maxWait time.Duration
+}
+
+// queuedUpdate is an update waiting in the queue, Provider and Settings are set for updates made
+// through a provider url and Host for updates to a configured hostname through /nic/update, where
+// Settings only has the form settings given with the request
+type queuedUpdate struct {
+	ID          uint64            `json:"id"`
+	Provider    string            `json:"provider,omitempty"`
+	Settings    map[string]string `json:"settings,omitempty"`
+	Host        bool              `json:"host,omitempty"`
+	Hostname    string            `json:"hostname"`
+	IPs         []string          `json:"ips"`
+	TTL         int               `json:"ttl"`
+	Queued      time.Time         `json:"queued"`
+	Attempts    int               `json:"attempts"`
+	NextAttempt time.Time         `json:"nextAttempt"`
+	LastError   string            `json:"lastError,omitempty"`
+}
+
+// queueFileData is the layout of the queue file
+type queueFileData struct {
+	NextID  uint64          `json:"nextId"`
+	Updates []*queuedUpdate `json:"updates"`
+}
+
+var updateQueue = struct {
+	sync.Mutex
+	nextID uint64
+	// pending is keyed by queueKey so a newer update replaces an older one
+	pending map[string]*queuedUpdate
+	// inFlight holds the keys being applied so a record is never updated by two workers at once
+	inFlight map[string]bool
+	wake     chan struct{}
+	// counters for /metrics
+	queued, applied, failed, superseded, retries int64
+}{pending: make(map[string]*queuedUpdate), inFlight: make(map[string]bool), wake: make(chan struct{}, 1)}
+
+func (c *AsyncConfig) compile() error {
+	if c.QueueFile == "" {
+		c.QueueFile = defaultQueueFile
+	}
+	if c.Workers == 0 {
+		c.Workers = defaultQueueWorkers
+	}
+	if c.Attempts == 0 {
+		c.Attempts = defaultQueueAttempts
+	}
+	if c.Workers < 1 || c.Attempts < 1 {
+		return errors.New("async has invalid workers or attempts")
+	}
+	var err error
+	c.wait, err = parseRetryDuration(c.Wait, defaultQueueWait)
+	if err != nil {
+		return errors.New("async has an invalid wait")
+	}
+	c.maxWait, err = parseRetryDuration(c.MaxWait, defaultQueueMaxWait)
+	if err != nil {
+		return errors.New("async has an invalid maxWait")
+	}
+	return nil
+}
+
+// asyncEnabled reports whether requests are queued rather than applied while the client waits
+func asyncEnabled() bool {
+	return config.Async != nil
+}
+
+// queueKey identifies the record an update is for, updates with the same key replace each other
+func queueKey(item *queuedUpdate) string {
+	if item.Host {
+		return "/nic/update " + hostKey(item.Hostname)
+	}
+	return item.Provider + " " + hostKey(item.Hostname)
+}
+
+// startQueue loads the updates left in the queue file and starts the workers
+func startQueue(c *AsyncConfig) error {
+	data, err := os.ReadFile(c.QueueFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if err == nil {
+		var saved queueFileData
+		err = json.Unmarshal(data, &saved)
+		if err != nil {
+			return errors.New("failed to parse " + c.QueueFile + ": " + err.Error())
+		}
+		updateQueue.nextID = saved.NextID
+		for _, item := range saved.Updates {
+			updateQueue.pending[queueKey(item)] = item
+		}
+		if len(saved.Updates) > 0 {
+			logger("loaded "+strconv.Itoa(len(saved.Updates))+" queued updates from "+c.QueueFile, "info")
+		}
+	}
+	for i := 0; i < c.Workers; i++ {
+		go queueWorker(c)
+	}
+	return nil
+}
+
+// enqueueUpdate saves an update to the queue, it's only acknowledged once it's on disk
+func enqueueUpdate(item *queuedUpdate) error {
+	updateQueue.Lock()
+	defer updateQueue.Unlock()
+	updateQueue.nextID++
+	item.ID = updateQueue.nextID
+	item.Queued = time.Now().UTC()
+	item.NextAttempt = item.Queued
+
+	key := queueKey(item)
+	previous, replaced := updateQueue.pending[key]
+	updateQueue.pending[key] = item
+	err := saveQueue(config.Async.QueueFile)
+	if err != nil {
+		if replaced {
+			updateQueue.pending[key] = previous
+		} else {
+			delete(updateQueue.pending, key)
+		}
+		return newDyndnsError(dyndns911, "failed to save queued update: "+err.Error())
+	}
+	updateQueue.queued++
+	if replaced {
+		updateQueue.superseded++
+	}
+	select {
+	case updateQueue.wake <- struct{}{}:
+	default:
+	}
+	return nil
+}
+
+// saveQueue writes the pending updates with writeFileAtomic, the file holds provider credentials so
+// only the owner can read it, it's called with the lock held
+func saveQueue(path string) error {
+	saved := queueFileData{NextID: updateQueue.nextID}
+	for _, item := range updateQueue.pending {
+		saved.Updates = append(saved.Updates, item)
+	}
+	slices.SortFunc(saved.Updates, func(a, b *queuedUpdate) int {
+		return cmp.Compare(a.ID, b.ID)
+	})
+	data, err := json.MarshalIndent(saved, "", "  ")
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data, 0600)
+}
+
+// nextQueued returns the pending update that has waited longest for its turn and marks it in
+// flight, or nil and how long until one is due
+func nextQueued(now time.Time) (*queuedUpdate, time.Duration) {
+	updateQueue.Lock()
+	defer updateQueue.Unlock()
+	var next *queuedUpdate
+	for _, item := range updateQueue.pending {
+		if updateQueue.inFlight[queueKey(item)] {
+			continue
+		}
+		if next == nil || item.NextAttempt.Before(next.NextAttempt) ||
+			(item.NextAttempt.Equal(next.NextAttempt) && item.ID < next.ID) {
+			next = item
+		}
+	}
+	if next == nil {
+		return nil, time.Minute
+	}
+	if wait := next.NextAttempt.Sub(now); wait > 0 {
+		return nil, wait
+	}
+	updateQueue.inFlight[queueKey(next)] = true
+	// pass the wake up on so another idle worker looks for more
+	select {
+	case updateQueue.wake <- struct{}{}:
+	default:
+	}
+	return next, 0
+}
+
+func queueWorker(c *AsyncConfig) {
+	for {
+		item, wait := nextQueued(time.Now())
+		if item == nil {
+			select {
+			case <-updateQueue.wake:
+			case <-time.After(wait):
+			}
+			continue
+		}
+		err := applyQueued(item)
+		finishQueued(c, item, err)
+	}
+}
+
+// applyQueued applies a queued update the same way it would have been applied while the client
+// waited, retries inside the request deadline included
+func applyQueued(item *queuedUpdate) error {
+	update := &dnsUpdate{hostname: item.Hostname, ips: item.IPs, ttl: item.TTL}
+	ctx, cancel := requestContext()
+	defer cancel()
+	if !item.Host {
+		if _, found := providers[item.Provider]; !found {
+			return errors.New("unknown provider " + item.Provider)
+		}
+		settings := make(map[string]string)
+		for key, value := range item.Settings {
+			settings[key] = value
+		}
+		return applyProvider(ctx, item.Provider, settings, update)
+	}
+	host, found := config.Hosts[hostKey(item.Hostname)]
+	if !found {
+		return newDyndnsError(dyndnsNoHost, "hostname is no longer configured")
+	}
+	results := applyTargets(ctx, host, update, item.Settings)
+	for _, result := range results {
+		if !applied(result.err) {
+			logger("queued update "+result.target+" "+result.err.Error(), "err")
+		}
+	}
+	return combineResults(host.Policy, results)
+}
+
+// finishQueued removes an update from the queue once it's done, or schedules it to be tried again
+// later when it failed in a way that might go away
+func finishQueued(c *AsyncConfig, item *queuedUpdate, err error) {
+	updateQueue.Lock()
+	defer updateQueue.Unlock()
+	key := queueKey(item)
+	delete(updateQueue.inFlight, key)
+
+	title := "/nic/update"
+	if p, found := providers[item.Provider]; found && !item.Host {
+		title = p.title
+	}
+	description := title + " DNS hostname: " + item.Hostname + " ip: " + strings.Join(item.IPs, ",")
+	class := classifyError(err)
+	item.Attempts++
+	var retry bool
+	switch {
+	case applied(err):
+		updateQueue.applied++
+		logger("queued update successfully applied "+description, "info")
+	case (class == errorTransient || class == errorRateLimited) && item.Attempts < c.Attempts:
+		retry = true
+		updateQueue.retries++
+		wait := c.wait
+		for i := 1; i < item.Attempts && wait < c.maxWait; i++ {
+			wait *= 2
+		}
+		item.NextAttempt = time.Now().UTC().Add(min(wait, c.maxWait))
+		item.LastError = err.Error()
+		logger("queued update failed "+description+" attempt "+strconv.Itoa(item.Attempts)+", retrying in "+min(wait, c.maxWait).String()+": "+err.Error(), "notice")
+	default:
+		updateQueue.failed++
+		logger("queued update dropped "+description+" after "+strconv.Itoa(item.Attempts)+" attempts: "+err.Error(), "err")
+	}
+
+	// a newer update for the same record may have arrived while this one was running, it stays
+	// and this one is dropped whatever happened to it
+	if current := updateQueue.pending[key]; current != nil && current.ID == item.ID && !retry {
+		delete(updateQueue.pending, key)
+	}
+	saveErr := saveQueue(c.QueueFile)
+	if saveErr != nil {
+		logger("failed to save update queue: "+saveErr.Error(), "err")
+	}
+}
+
+// queueStatus is the queue as shown by /status, settings are left out
+type queueStatus struct {
+	Depth      int                 `json:"depth"`
+	InFlight   int                 `json:"inFlight"`
+	Queued     int64               `json:"queued"`
+	Applied    int64               `json:"applied"`
+	Failed     int64               `json:"failed"`
+	Superseded int64               `json:"superseded"`
+	Retries    int64               `json:"retries"`
+	Pending    []queueStatusUpdate `json:"pending"`
+}
+
+type queueStatusUpdate struct {
+	Route       string    `json:"route"`
+	Hostname    string    `json:"hostname"`
+	IPs         []string  `json:"ips"`
+	Queued      time.Time `json:"queued"`
+	Attempts    int       `json:"attempts"`
+	NextAttempt time.Time `json:"nextAttempt"`
+	LastError   string    `json:"lastError,omitempty"`
+}
+
+func queueStatusNow() *queueStatus {
+	updateQueue.Lock()
+	defer updateQueue.Unlock()
+	status := &queueStatus{
+		Depth:      len(updateQueue.pending),
+		InFlight:   len(updateQueue.inFlight),
+		Queued:     updateQueue.queued,
+		Applied:    updateQueue.applied,
+		Failed:     updateQueue.failed,
+		Superseded: updateQueue.superseded,
+		Retries:    updateQueue.retries,
+		Pending:    []queueStatusUpdate{},
+	}
+	for _, item := range updateQueue.pending {
+		route := "/" + item.Provider + "/"
+		if item.Host {
+			route = "/nic/update"
+		}
+		status.Pending = append(status.Pending, queueStatusUpdate{
+			Route:       route,
+			Hostname:    item.Hostname,
+			IPs:         item.IPs,
+			Queued:      item.Queued,
+			Attempts:    item.Attempts,
+			NextAttempt: item.NextAttempt,
+			LastError:   item.LastError,
+		})
+	}
+	slices.SortFunc(status.Pending, func(a, b queueStatusUpdate) int {
+		return a.Queued.Compare(b.Queued)
+	})
+	return status
+}
@@ -0,0 +1,295 @@
+package main
+
+// This file contains the retries shared by every provider, errors are sorted into auth, not found,
+// rate limited and transient by looking at what each sdk returns, transient and rate limited ones
+// are retried with jittered exponential backoff as long as the request deadline allows
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Azure/azure-sdk-for-go/sdk/azcore"
+	"github.com/Azure/azure-sdk-for-go/sdk/azidentity"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/cloudflare/cloudflare-go"
+	"github.com/digitalocean/godo"
+)
+
+const (
+	defaultRetryAttempts = 4
+	defaultRetryWait     = time.Second
+	defaultRetryMaxWait  = 10 * time.Second
+	// routers usually give up on the http request after about 30 seconds, so stop before they do
+	defaultRetryDeadline = 25 * time.Second
+)
+
+type errorClass int
+
+const (
+	// errorUnknown is an error nothing is known about, it isn't retried
+	errorUnknown errorClass = iota
+	errorAuth
+	errorNotFound
+	errorRateLimited
+	errorTransient
+	// errorPermanent is a request the provider will never accept as it is
+	errorPermanent
+)
+
+// RetryConfig is the "retry" section of the config, the durations are go durations like "1s"
+type RetryConfig struct {
+	// Attempts is how many times an update is tried in total, 1 turns retries off
+	Attempts int `json:"attempts"`
+	// Wait is the backoff before the first retry, it doubles up to MaxWait
+	Wait    string `json:"wait"`
+	MaxWait string `json:"maxWait"`
+	// Deadline is how long a request may take including every retry
+	Deadline string `json:"deadline"`
+
+	wait, maxWait, deadline time.Duration
+}
+
+func (c *RetryConfig) compile() error {
+	if c.Attempts == 0 {
+		c.Attempts = defaultRetryAttempts
+	}
+	if c.Attempts < 1 {
+		return errors.New("retry has invalid attempts")
+	}
+	var err error
+	c.wait, err = parseRetryDuration(c.Wait, defaultRetryWait)
+	if err != nil {
+		return errors.New("retry has an invalid wait")
+	}
+	c.maxWait, err = parseRetryDuration(c.MaxWait, defaultRetryMaxWait)
+	if err != nil {
+		return errors.New("retry has an invalid maxWait")
+	}
+	c.deadline, err = parseRetryDuration(c.Deadline, defaultRetryDeadline)
+	if err != nil {
+		return errors.New("retry has an invalid deadline")
+	}
+	return nil
+}
+
+func parseRetryDuration(value string, fallback time.Duration) (time.Duration, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err == nil && duration <= 0 {
+		err = errors.New("duration must be positive")
+	}
+	return duration, err
+}
+
+// retrySettings returns the configured retry settings or the defaults
+func retrySettings() *RetryConfig {
+	if config.Retry != nil {
+		return config.Retry
+	}
+	return &RetryConfig{Attempts: defaultRetryAttempts, wait: defaultRetryWait, maxWait: defaultRetryMaxWait, deadline: defaultRetryDeadline}
+}
+
+// requestContext is the context an update runs under, every retry has to fit inside its deadline
+func requestContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), retrySettings().deadline)
+}
+
+// withRetry runs apply until it succeeds, fails with an error that isn't worth retrying or runs
+// out of attempts or time, the error returned carries the dyndns code for its class, apply is
+// only run once when retry is false
+func withRetry(ctx context.Context, title string, retry bool, apply func(ctx context.Context) error) error {
+	settings := retrySettings()
+	wait := settings.wait
+	for attempt := 1; ; attempt++ {
+		err := apply(ctx)
+		class := classifyError(err)
+		if err == nil || !retry || (class != errorTransient && class != errorRateLimited) || attempt >= settings.Attempts {
+			return classifiedError(err)
+		}
+
+		// full jitter between half and all of the backoff so clients that failed together don't
+		// all come back together, a Retry-After from the provider wins
+		delay := wait/2 + rand.N(wait/2+1)
+		if retryAfter := errorRetryAfter(err); retryAfter > 0 {
+			delay = retryAfter
+		}
+		if deadline, ok := ctx.Deadline(); ok && time.Until(deadline) < delay {
+			return classifiedError(err)
+		}
+		logger(title+" attempt "+strconv.Itoa(attempt)+" failed, retrying in "+delay.Round(time.Millisecond).String()+": "+err.Error(), "notice")
+		select {
+		case <-ctx.Done():
+			return classifiedError(err)
+		case <-time.After(delay):
+		}
+		wait = min(wait*2, settings.maxWait)
+	}
+}
+
+// classifiedError gives an error from a provider the dyndns code for its class so clients can tell
+// a bad login from an outage, errors that already have a code keep it
+func classifiedError(err error) error {
+	if applied(err) {
+		return err
+	}
+	var dyndnsErr *dyndnsError
+	if errors.As(err, &dyndnsErr) {
+		return err
+	}
+	if errors.Is(err, context.DeadlineExceeded) {
+		return &dyndnsError{code: dyndns911, err: err}
+	}
+	switch classifyError(err) {
+	case errorAuth:
+		return &dyndnsError{code: dyndnsBadAuth, err: err}
+	case errorNotFound:
+		return &dyndnsError{code: dyndnsNoHost, err: err}
+	case errorRateLimited:
+		return &dyndnsError{code: dyndnsAbuse, err: err}
+	}
+	return err
+}
+
+// classifyError sorts an error by what each sdk and api reports about it
+func classifyError(err error) errorClass {
+	if applied(err) {
+		return errorUnknown
+	}
+
+	var dyndnsErr *dyndnsError
+	if errors.As(err, &dyndnsErr) {
+		switch dyndnsErr.code {
+		case dyndnsBadAuth:
+			return errorAuth
+		case dyndnsNoHost:
+			return errorNotFound
+		case dyndnsAbuse:
+			return errorRateLimited
+		case dyndns911:
+			return errorTransient
+		case dyndnsBadAgent, dyndnsNotFQDN:
+			return errorPermanent
+		}
+		// dnserr says nothing more, the error it wraps might
+	}
+
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return classifyStatus(apiErr.statusCode)
+	}
+
+	// aws reports throttling and auth problems by error code, the status code covers the rest
+	var awsErr awserr.Error
+	if errors.As(err, &awsErr) {
+		switch awsErr.Code() {
+		case "Throttling", "ThrottlingException", "PriorRequestNotComplete", "RequestLimitExceeded":
+			return errorRateLimited
+		case "InvalidClientTokenId", "SignatureDoesNotMatch", "AccessDenied", "AccessDeniedException",
+			"UnrecognizedClientException", "ExpiredToken", "ExpiredTokenException", "InvalidSignatureException",
+			"NoCredentialProviders", "SharedConfigProfileNotExists":
+			return errorAuth
+		case "NoSuchHostedZone":
+			return errorNotFound
+		case "ServiceUnavailable", "InternalFailure", "InternalError", "RequestError", "RequestTimeout":
+			return errorTransient
+		}
+		var failure awserr.RequestFailure
+		if errors.As(err, &failure) && failure.StatusCode() > 0 {
+			return classifyStatus(failure.StatusCode())
+		}
+		return errorUnknown
+	}
+
+	var azureErr *azcore.ResponseError
+	if errors.As(err, &azureErr) {
+		return classifyStatus(azureErr.StatusCode)
+	}
+	var azureAuthErr *azidentity.AuthenticationFailedError
+	if errors.As(err, &azureAuthErr) {
+		if azureAuthErr.RawResponse != nil && azureAuthErr.RawResponse.StatusCode >= 500 {
+			return errorTransient
+		}
+		return errorAuth
+	}
+
+	// cloudflare-go doesn't set the type on its 5xx errors so they're checked for first, every
+	// other cloudflare error has Type
+	var cfServiceErr *cloudflare.ServiceError
+	if errors.As(err, &cfServiceErr) {
+		return errorTransient
+	}
+	var cfErr interface{ Type() cloudflare.ErrorType }
+	if errors.As(err, &cfErr) {
+		switch cfErr.Type() {
+		case cloudflare.ErrorTypeAuthentication, cloudflare.ErrorTypeAuthorization:
+			return errorAuth
+		case cloudflare.ErrorTypeNotFound:
+			return errorNotFound
+		case cloudflare.ErrorTypeRateLimit:
+			return errorRateLimited
+		case cloudflare.ErrorTypeService:
+			return errorTransient
+		}
+		return errorPermanent
+	}
+
+	var doErr *godo.ErrorResponse
+	if errors.As(err, &doErr) && doErr.Response != nil {
+		return classifyStatus(doErr.Response.StatusCode)
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, context.DeadlineExceeded) {
+		return errorTransient
+	}
+
+	// with its own retries turned off cloudflare-go reports 429s and 5xxs without a type
+	if strings.Contains(err.Error(), "exceeded available rate limit retries") {
+		return errorRateLimited
+	}
+	if strings.Contains(err.Error(), "please try again later") {
+		return errorTransient
+	}
+	return errorUnknown
+}
+
+func classifyStatus(status int) errorClass {
+	switch {
+	case status == http.StatusUnauthorized || status == http.StatusForbidden:
+		return errorAuth
+	case status == http.StatusNotFound:
+		return errorNotFound
+	case status == http.StatusTooManyRequests:
+		return errorRateLimited
+	case status == http.StatusRequestTimeout || status >= 500:
+		return errorTransient
+	case status >= 400:
+		return errorPermanent
+	}
+	return errorUnknown
+}
+
+// errorRetryAfter is how long the provider asked us to wait, zero when it didn't say
+func errorRetryAfter(err error) time.Duration {
+	var apiErr *apiError
+	if errors.As(err, &apiErr) {
+		return apiErr.retryAfter
+	}
+	var azureErr *azcore.ResponseError
+	if errors.As(err, &azureErr) && azureErr.RawResponse != nil {
+		return parseRetryAfter(azureErr.RawResponse.Header.Get("Retry-After"))
+	}
+	var doErr *godo.ErrorResponse
+	if errors.As(err, &doErr) && doErr.Response != nil {
+		return parseRetryAfter(doErr.Response.Header.Get("Retry-After"))
+	}
+	return 0
+}
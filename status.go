@@ -0,0 +1,99 @@
+package main
+
+// This file contains /status, a json view of how the configured targets and the update queue are
+// doing, and /metrics, the same numbers in the prometheus text format, neither ever includes
+// settings so no credentials can leak through them
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+)
+
+type statusResponse struct {
+	Targets map[string]targetStatus `json:"targets"`
+	// Queue is only shown in async mode
+	Queue *queueStatus `json:"queue,omitempty"`
+}
+
+// statusAllowed checks for the login of any configured client, the target names and errors say
+// a fair bit about the setup even without credentials
+func statusAllowed(w http.ResponseWriter, r *http.Request) bool {
+	username, password, _ := r.BasicAuth()
+	if configClient(username, password) == nil {
+		http.Error(w, dyndnsBadAuth+" "+errUnauthorized.Error(), http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func statusHandler(w http.ResponseWriter, r *http.Request) {
+	if !statusAllowed(w, r) {
+		return
+	}
+	status := statusResponse{Targets: healthStatus(time.Now())}
+	if asyncEnabled() {
+		status.Queue = queueStatusNow()
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(status)
+}
+
+var metricLabelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if !statusAllowed(w, r) {
+		return
+	}
+	var out strings.Builder
+	metric := func(name, kind, help string) {
+		fmt.Fprintf(&out, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	}
+
+	if asyncEnabled() {
+		queue := queueStatusNow()
+		metric("cloud_ddns_queue_depth", "gauge", "Updates waiting in the queue.")
+		fmt.Fprintf(&out, "cloud_ddns_queue_depth %d\n", queue.Depth)
+		metric("cloud_ddns_queue_in_flight", "gauge", "Queued updates being applied.")
+		fmt.Fprintf(&out, "cloud_ddns_queue_in_flight %d\n", queue.InFlight)
+		metric("cloud_ddns_queue_updates_total", "counter", "Queued updates by what happened to them.")
+		fmt.Fprintf(&out, "cloud_ddns_queue_updates_total{result=\"queued\"} %d\n", queue.Queued)
+		fmt.Fprintf(&out, "cloud_ddns_queue_updates_total{result=\"applied\"} %d\n", queue.Applied)
+		fmt.Fprintf(&out, "cloud_ddns_queue_updates_total{result=\"failed\"} %d\n", queue.Failed)
+		fmt.Fprintf(&out, "cloud_ddns_queue_updates_total{result=\"superseded\"} %d\n", queue.Superseded)
+		metric("cloud_ddns_queue_retries_total", "counter", "Queued updates scheduled to be tried again.")
+		fmt.Fprintf(&out, "cloud_ddns_queue_retries_total %d\n", queue.Retries)
+	}
+
+	targets := healthStatus(time.Now())
+	var names []string
+	for name := range targets {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	if len(names) > 0 {
+		metric("cloud_ddns_target_up", "gauge", "1 while the target's circuit is closed.")
+		for _, name := range names {
+			up := 0
+			if targets[name].State == circuitClosed {
+				up = 1
+			}
+			fmt.Fprintf(&out, "cloud_ddns_target_up{target=\"%s\",provider=\"%s\"} %d\n", metricLabelEscaper.Replace(name), targets[name].Provider, up)
+		}
+		metric("cloud_ddns_target_consecutive_failures", "gauge", "Transient failures in a row.")
+		for _, name := range names {
+			fmt.Fprintf(&out, "cloud_ddns_target_consecutive_failures{target=\"%s\"} %d\n", metricLabelEscaper.Replace(name), targets[name].ConsecutiveFailures)
+		}
+		metric("cloud_ddns_target_updates_total", "counter", "Updates applied to the target by result.")
+		for _, name := range names {
+			fmt.Fprintf(&out, "cloud_ddns_target_updates_total{target=\"%s\",result=\"success\"} %d\n", metricLabelEscaper.Replace(name), targets[name].Successes)
+			fmt.Fprintf(&out, "cloud_ddns_target_updates_total{target=\"%s\",result=\"failure\"} %d\n", metricLabelEscaper.Replace(name), targets[name].Failures)
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(out.String()))
+}
@@ -0,0 +1,247 @@
+package main
+
+// The generic http provider, it sends a request built from go templates in the server config so
+// in-house apis and niche dns hosts can be updated without writing a new provider
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+// HTTPProvider is a request template from the "http" section of the config, every string field
+// except Zone is a go template over webhookData
+type HTTPProvider struct {
+	Method  string            `json:"method"`
+	URL     string            `json:"url"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	// Zone lets the templates use .Zone and .Subdomain, hostnames outside it are refused
+	Zone    string      `json:"zone"`
+	Success HTTPSuccess `json:"success"`
+
+	method, url, body *template.Template
+	headers           map[string]*template.Template
+}
+
+// HTTPSuccess decides whether the response means the update worked, with nothing set any 2xx
+// status code is a success
+type HTTPSuccess struct {
+	Status []int `json:"status"`
+	// JSONPath is a path into the json response like $.result.status or $.records[0].ip, the
+	// value there has to equal Equals, or just exist when Equals is empty
+	JSONPath string `json:"jsonPath"`
+	Equals   string `json:"equals"`
+}
+
+// webhookData is what the templates are executed with, one request is made per record type
+type webhookData struct {
+	Hostname  string
+	Zone      string
+	Subdomain string
+	IP        string
+	IPs       []string
+	Type      string
+	TTL       int
+}
+
+var webhookFuncs = template.FuncMap{
+	// json quotes a value for use inside a json body ie {"ip": {{json .IP}}}
+	"json": func(v interface{}) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// compile parses the method, url, body and header templates
+func (h *HTTPProvider) compile(name string) error {
+	var err error
+	if h.Method == "" {
+		h.Method = "POST"
+	}
+	if h.URL == "" {
+		return errors.New("http provider " + name + " has no url")
+	}
+	h.method, err = template.New(name + " method").Funcs(webhookFuncs).Parse(h.Method)
+	if err != nil {
+		return err
+	}
+	h.url, err = template.New(name + " url").Funcs(webhookFuncs).Parse(h.URL)
+	if err != nil {
+		return err
+	}
+	h.body, err = template.New(name + " body").Funcs(webhookFuncs).Parse(h.Body)
+	if err != nil {
+		return err
+	}
+	h.headers = make(map[string]*template.Template)
+	for header, value := range h.Headers {
+		h.headers[header], err = template.New(name + " " + header).Funcs(webhookFuncs).Parse(value)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func webhookUpdate(ctx context.Context, settings map[string]string, update *dnsUpdate) error {
+	name := settings["name"]
+	h, found := config.HTTP[name]
+	if !found {
+		return errors.New("http provider " + name + " not found in config")
+	}
+
+	// a client's zone setting takes the place of the template's, so one template can serve clients
+	// that are each held to their own zone or subzone
+	zone := h.Zone
+	if settings["zone"] != "" {
+		zone = settings["zone"]
+	}
+	var subdomain string
+	if zone != "" {
+		var err error
+		subdomain, err = subdomainOf(update.hostname, zone)
+		if err != nil {
+			return err
+		}
+	}
+
+	byType := ipsByType(update.ips)
+	for _, fieldType := range []string{"A", "AAAA"} {
+		if len(byType[fieldType]) == 0 {
+			continue
+		}
+		data := webhookData{
+			Hostname:  update.hostname,
+			Zone:      zone,
+			Subdomain: subdomain,
+			IP:        byType[fieldType][0],
+			IPs:       byType[fieldType],
+			Type:      fieldType,
+			TTL:       update.ttl,
+		}
+		err := h.send(ctx, name, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (h *HTTPProvider) send(ctx context.Context, name string, data webhookData) error {
+	method, err := executeTemplate(h.method, data)
+	if err != nil {
+		return err
+	}
+	url, err := executeTemplate(h.url, data)
+	if err != nil {
+		return err
+	}
+	body, err := executeTemplate(h.body, data)
+	if err != nil {
+		return err
+	}
+
+	var reqBody io.Reader
+	if body != "" {
+		reqBody = strings.NewReader(body)
+	}
+	req, err := http.NewRequestWithContext(ctx, strings.ToUpper(strings.TrimSpace(method)), strings.TrimSpace(url), reqBody)
+	if err != nil {
+		return err
+	}
+	for header, tmpl := range h.headers {
+		value, err := executeTemplate(tmpl, data)
+		if err != nil {
+			return err
+		}
+		req.Header.Set(header, value)
+	}
+
+	resp, err := apiHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if !h.Success.statusOK(resp.StatusCode) {
+		return &apiError{
+			provider:   "HTTP " + name,
+			statusCode: resp.StatusCode,
+			body:       string(respBody),
+			retryAfter: parseRetryAfter(resp.Header.Get("Retry-After")),
+		}
+	}
+	if h.Success.JSONPath != "" {
+		var doc interface{}
+		err = json.Unmarshal(respBody, &doc)
+		if err != nil {
+			return errors.New("http provider " + name + " response is not json: " + err.Error())
+		}
+		value, found := jsonPathLookup(doc, h.Success.JSONPath)
+		if !found {
+			return errors.New("http provider " + name + " response has nothing at " + h.Success.JSONPath)
+		}
+		if h.Success.Equals != "" && fmt.Sprint(value) != h.Success.Equals {
+			return errors.New("http provider " + name + " response has " + fmt.Sprint(value) + " at " + h.Success.JSONPath + " expected " + h.Success.Equals)
+		}
+	}
+	return nil
+}
+
+func (s HTTPSuccess) statusOK(status int) bool {
+	if len(s.Status) == 0 {
+		return status >= 200 && status < 300
+	}
+	for _, ok := range s.Status {
+		if status == ok {
+			return true
+		}
+	}
+	return false
+}
+
+func executeTemplate(tmpl *template.Template, data webhookData) (string, error) {
+	var buf bytes.Buffer
+	err := tmpl.Execute(&buf, data)
+	return buf.String(), err
+}
+
+// jsonPathLookup follows a simple json path, $.a.b[0].c or a.b.0.c, through a decoded json document
+func jsonPathLookup(doc interface{}, path string) (interface{}, bool) {
+	path = strings.TrimPrefix(strings.TrimPrefix(path, "$"), ".")
+	path = strings.ReplaceAll(strings.ReplaceAll(path, "[", "."), "]", "")
+	if path == "" {
+		return doc, true
+	}
+	for _, key := range strings.Split(path, ".") {
+		switch node := doc.(type) {
+		case map[string]interface{}:
+			value, found := node[key]
+			if !found {
+				return nil, false
+			}
+			doc = value
+		case []interface{}:
+			index, err := strconv.Atoi(key)
+			if err != nil || index < 0 || index >= len(node) {
+				return nil, false
+			}
+			doc = node[index]
+		default:
+			return nil, false
+		}
+	}
+	return doc, true
+}
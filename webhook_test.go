@@ -0,0 +1,142 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// testWebhook configures the http provider "hook" for the rest of the test
+func testWebhook(t *testing.T, h *HTTPProvider) {
+	t.Helper()
+	err := h.compile("hook")
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := config
+	config = &Config{HTTP: map[string]*HTTPProvider{"hook": h}}
+	t.Cleanup(func() { config = saved })
+}
+
+func TestJSONPathLookup(t *testing.T) {
+	var doc interface{}
+	json.Unmarshal([]byte(`{"result":{"status":"ok","count":2,"done":true},"records":[{"ip":"192.0.2.1"},{"ip":"192.0.2.2"}]}`), &doc)
+	tests := []struct {
+		path  string
+		want  string
+		found bool
+	}{
+		{"$.result.status", "ok", true},
+		{"result.status", "ok", true},
+		{"$.records[1].ip", "192.0.2.2", true},
+		{"records.0.ip", "192.0.2.1", true},
+		{"$.result.count", "2", true},
+		{"$.result.done", "true", true},
+		{"$.result.missing", "", false},
+		{"$.records[2].ip", "", false},
+		{"$.records[-1].ip", "", false},
+		{"$.records.first", "", false},
+		{"$.result.status.deeper", "", false},
+	}
+	for _, test := range tests {
+		value, found := jsonPathLookup(doc, test.path)
+		if found != test.found || (found && fmt.Sprint(value) != test.want) {
+			t.Errorf("jsonPathLookup(%q) = %v, %v, want %q, %v", test.path, value, found, test.want, test.found)
+		}
+	}
+	if whole, found := jsonPathLookup(doc, "$"); !found || whole == nil {
+		t.Error("$ didn't return the whole document")
+	}
+}
+
+func TestWebhookUpdateRequests(t *testing.T) {
+	var endpoint string
+	mock := startMockAPI(t, &endpoint, func(w http.ResponseWriter, call apiCall) {
+		w.Write([]byte(`{"ok":true}`))
+	})
+	testWebhook(t, &HTTPProvider{
+		Method:  "put",
+		URL:     endpoint + "/zones/{{.Zone}}/{{.Subdomain}}/{{.Type}}",
+		Headers: map[string]string{"Authorization": "Bearer token-for-{{.Hostname}}"},
+		Body:    `{"ip":{{json .IP}},"ips":{{json .IPs}},"ttl":{{.TTL}}}`,
+		Zone:    "example.com",
+	})
+
+	update := &dnsUpdate{hostname: "home.example.com", ips: []string{"192.0.2.1", "2001:db8::1", "192.0.2.2"}, ttl: 120}
+	err := webhookUpdate(t.Context(), map[string]string{"name": "hook"}, update)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	want := []string{"PUT /zones/example.com/home/A", "PUT /zones/example.com/home/AAAA"}
+	if got := mock.requests(); !slices.Equal(got, want) {
+		t.Errorf("requests = %v, want %v", got, want)
+	}
+	wantBodies := []string{
+		`{"ip":"192.0.2.1","ips":["192.0.2.1","192.0.2.2"],"ttl":120}`,
+		`{"ip":"2001:db8::1","ips":["2001:db8::1"],"ttl":120}`,
+	}
+	for i, call := range mock.received() {
+		if call.body != wantBodies[i] {
+			t.Errorf("body %d = %s, want %s", i, call.body, wantBodies[i])
+		}
+		if auth := call.header.Get("Authorization"); auth != "Bearer token-for-home.example.com" {
+			t.Errorf("authorization %d = %q", i, auth)
+		}
+	}
+
+	// a client's zone takes the place of the template's and refuses hostnames outside it
+	err = webhookUpdate(t.Context(), map[string]string{"name": "hook", "zone": "dyn.example.com"}, update)
+	if dyndnsCode(err) != dyndnsNoHost {
+		t.Errorf("err = %v, want nohost", err)
+	}
+	if len(mock.requests()) != 2 {
+		t.Error("request sent for a hostname outside the client's zone")
+	}
+}
+
+func TestWebhookUpdateSuccess(t *testing.T) {
+	tests := []struct {
+		name     string
+		success  HTTPSuccess
+		status   int
+		response string
+		wantErr  string
+		wantCode string
+	}{
+		{"any 2xx by default", HTTPSuccess{}, http.StatusCreated, `{}`, "", dyndnsGood},
+		{"error status by default", HTTPSuccess{}, http.StatusInternalServerError, `oops`, "HTTP hook API error 500: oops", dyndnsDNSErr},
+		{"listed status only", HTTPSuccess{Status: []int{200}}, http.StatusCreated, `{}`, "HTTP hook API error 201", dyndnsDNSErr},
+		{"listed status that isn't 2xx", HTTPSuccess{Status: []int{200, 409}}, http.StatusConflict, `{}`, "", dyndnsGood},
+		{"json path equals", HTTPSuccess{JSONPath: "$.result.status", Equals: "ok"}, http.StatusOK, `{"result":{"status":"ok"}}`, "", dyndnsGood},
+		{"json path equals a number", HTTPSuccess{JSONPath: "$.records[0].count", Equals: "1"}, http.StatusOK, `{"records":[{"count":1}]}`, "", dyndnsGood},
+		{"json path has another value", HTTPSuccess{JSONPath: "$.result.status", Equals: "ok"}, http.StatusOK, `{"result":{"status":"failed"}}`,
+			"http provider hook response has failed at $.result.status expected ok", dyndnsDNSErr},
+		{"json path only has to exist", HTTPSuccess{JSONPath: "$.id"}, http.StatusOK, `{"id":"r1"}`, "", dyndnsGood},
+		{"json path missing", HTTPSuccess{JSONPath: "$.id"}, http.StatusOK, `{"error":"no"}`, "http provider hook response has nothing at $.id", dyndnsDNSErr},
+		{"response isn't json", HTTPSuccess{JSONPath: "$.id"}, http.StatusOK, `done`, "http provider hook response is not json", dyndnsDNSErr},
+		{"status checked before the json path", HTTPSuccess{JSONPath: "$.id"}, http.StatusUnauthorized, `{"id":"r1"}`, "HTTP hook API error 401", dyndnsBadAuth},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			var endpoint string
+			startMockAPI(t, &endpoint, func(w http.ResponseWriter, call apiCall) {
+				w.WriteHeader(test.status)
+				w.Write([]byte(test.response))
+			})
+			testWebhook(t, &HTTPProvider{URL: endpoint + "/update", Success: test.success})
+			err := webhookUpdate(t.Context(), map[string]string{"name": "hook"}, &dnsUpdate{hostname: "home.example.com", ips: []string{"192.0.2.1"}, ttl: 300})
+			if test.wantErr == "" && err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if test.wantErr != "" && (err == nil || !strings.HasPrefix(err.Error(), test.wantErr)) {
+				t.Fatalf("err = %v, want %q", err, test.wantErr)
+			}
+			if code := dyndnsCode(classifiedError(err)); code != test.wantCode {
+				t.Errorf("code = %s, want %s", code, test.wantCode)
+			}
+		})
+	}
+}
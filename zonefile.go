@@ -0,0 +1,314 @@
+package main
+
+// The zonefile provider keeps records in a BIND format zone file on disk, so cloud-ddns can be used
+// with bind, knot or nsd on sites with no cloud dns at all. The file is parsed, the hostname's rrsets
+// replaced, the SOA serial bumped and the file written back with a rename so the dns server never
+// sees half a zone, then the optional reload command tells the server to pick it up.
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ZoneFile is a zone from the "zonefiles" section of the config, the path never comes from the
+// request so clients can only touch the files listed here
+type ZoneFile struct {
+	File string `json:"file"`
+	// Zone is the zone's origin, it defaults to the owner of the file's SOA record
+	Zone string `json:"zone"`
+	// Reload is run after the file is written ie ["rndc", "reload", "example.com"]
+	Reload []string `json:"reload"`
+	// Timeout is a go duration like "30s" for the reload command
+	Timeout string `json:"timeout"`
+
+	timeout time.Duration
+}
+
+// updates to the same file are serialized so two clients can't both read the old serial
+var zoneFileLocks sync.Map
+
+// compile checks there is a file and parses the reload timeout
+func (z *ZoneFile) compile(name string) error {
+	if z.File == "" {
+		return errors.New("zone file " + name + " has no file")
+	}
+	z.timeout = execDefaultTimeout
+	if z.Timeout != "" {
+		timeout, err := time.ParseDuration(z.Timeout)
+		if err != nil || timeout <= 0 {
+			return errors.New("zone file " + name + " has an invalid timeout")
+		}
+		z.timeout = timeout
+	}
+	return nil
+}
+
+func zoneFileUpdate(ctx context.Context, settings map[string]string, update *dnsUpdate) error {
+	name := settings["name"]
+	z, found := config.Zonefiles[name]
+	if !found {
+		return errors.New("zone file " + name + " not found in config")
+	}
+	// the hostname ends up in the file as text, so it's checked here too for queued updates
+	if !validHostname(update.hostname) {
+		return newDyndnsError(dyndnsNotFQDN, "hostname invalid")
+	}
+
+	if settings["zone"] != "" {
+		_, err := subdomainOf(update.hostname, settings["zone"])
+		if err != nil {
+			return err
+		}
+	}
+
+	lock, _ := zoneFileLocks.LoadOrStore(z.File, &sync.Mutex{})
+	lock.(*sync.Mutex).Lock()
+	defer lock.(*sync.Mutex).Unlock()
+
+	records, origin, err := z.read()
+	if err != nil {
+		return err
+	}
+	owner := dns.CanonicalName(update.hostname)
+	if !dns.IsSubDomain(origin, owner) {
+		return newDyndnsError(dyndnsNoHost, "hostname does not match zone")
+	}
+	var changed bool
+	byType := ipsByType(update.ips)
+	for _, fieldType := range []string{"A", "AAAA"} {
+		if len(byType[fieldType]) == 0 {
+			continue
+		}
+		var replaced bool
+		records, replaced, err = replaceRRSet(records, owner, fieldType, byType[fieldType], update.ttl)
+		if err != nil {
+			return err
+		}
+		changed = changed || replaced
+	}
+	if !changed {
+		return errNoChange
+	}
+
+	bumpSerial(records, time.Now())
+	err = z.write(origin, records)
+	if err != nil {
+		return errors.New("failed to write zone file: " + err.Error())
+	}
+	return z.reload(ctx, name)
+}
+
+// read parses the zone file and returns its records and origin, $INCLUDE isn't allowed since the
+// file is written back out as a single flat file
+func (z *ZoneFile) read() ([]dns.RR, string, error) {
+	data, err := os.ReadFile(z.File)
+	if err != nil {
+		return nil, "", errors.New("failed to read zone file: " + err.Error())
+	}
+	origin := ""
+	if z.Zone != "" {
+		origin = dns.CanonicalName(z.Zone)
+	}
+
+	var records []dns.RR
+	parser := dns.NewZoneParser(bytes.NewReader(data), origin, z.File)
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		records = append(records, rr)
+	}
+	if err := parser.Err(); err != nil {
+		return nil, "", errors.New("failed to parse zone file: " + err.Error())
+	}
+
+	var soa *dns.SOA
+	for _, rr := range records {
+		if s, ok := rr.(*dns.SOA); ok {
+			soa = s
+			break
+		}
+	}
+	if soa == nil {
+		return nil, "", errors.New("zone file " + z.File + " has no SOA record")
+	}
+	if origin == "" {
+		origin = dns.CanonicalName(soa.Hdr.Name)
+	}
+	return records, origin, nil
+}
+
+// replaceRRSet swaps the owner's rrset of fieldType for ips, the new records go where the old
+// ones were or after the owner's other records so the file stays readable, it reports whether
+// anything actually changed
+func replaceRRSet(records []dns.RR, owner, fieldType string, ips []string, ttl int) ([]dns.RR, bool, error) {
+	rrType := dns.StringToType[fieldType]
+	// the records are built rather than parsed from text so nothing in the request can be read as
+	// another record
+	var newSet []dns.RR
+	hdr := dns.RR_Header{Name: owner, Rrtype: rrType, Class: dns.ClassINET, Ttl: uint32(ttl)}
+	for _, ip := range ips {
+		addr := net.ParseIP(ip)
+		if addr == nil {
+			return nil, false, newDyndnsError(dyndnsBadAgent, "ip address invalid")
+		}
+		if rrType == dns.TypeA {
+			newSet = append(newSet, &dns.A{Hdr: hdr, A: addr})
+		} else {
+			newSet = append(newSet, &dns.AAAA{Hdr: hdr, AAAA: addr})
+		}
+	}
+
+	var kept, oldSet []dns.RR
+	insertAt := -1
+	for _, rr := range records {
+		hdr := rr.Header()
+		if dns.CanonicalName(hdr.Name) != owner {
+			kept = append(kept, rr)
+			continue
+		}
+		if hdr.Rrtype == dns.TypeCNAME {
+			// a CNAME can't have other data beside it, named would refuse to load the zone
+			return nil, false, errors.New("hostname " + owner + " is a CNAME in the zone file")
+		}
+		if hdr.Rrtype == rrType {
+			if insertAt == -1 {
+				insertAt = len(kept)
+			}
+			oldSet = append(oldSet, rr)
+			continue
+		}
+		kept = append(kept, rr)
+		if len(oldSet) == 0 {
+			insertAt = len(kept)
+		}
+	}
+
+	if sameRRSet(oldSet, newSet) {
+		return records, false, nil
+	}
+	if insertAt == -1 {
+		insertAt = len(kept)
+	}
+	return slices.Insert(kept, insertAt, newSet...), true, nil
+}
+
+// sameRRSet compares rrsets ignoring order, ttls included
+func sameRRSet(a, b []dns.RR) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	var aStrings, bStrings []string
+	for i := range a {
+		aStrings = append(aStrings, dns.CanonicalName(a[i].String()))
+		bStrings = append(bStrings, dns.CanonicalName(b[i].String()))
+	}
+	slices.Sort(aStrings)
+	slices.Sort(bStrings)
+	return slices.Equal(aStrings, bStrings)
+}
+
+// bumpSerial increments the SOA serial, serials already in the YYYYMMDDnn convention move to
+// today's date when they're behind it so they keep meaning something
+func bumpSerial(records []dns.RR, now time.Time) {
+	for _, rr := range records {
+		soa, ok := rr.(*dns.SOA)
+		if !ok {
+			continue
+		}
+		today, _ := strconv.ParseUint(now.UTC().Format("20060102")+"00", 10, 32)
+		if soa.Serial >= 1970010100 && soa.Serial < uint32(today) {
+			soa.Serial = uint32(today)
+		} else {
+			// wraps around at 2^32 which is fine under serial number arithmetic
+			soa.Serial++
+		}
+		return
+	}
+}
+
+// write replaces the zone file with records, a reader sees either the old zone or the new one
+func (z *ZoneFile) write(origin string, records []dns.RR) error {
+	var buf bytes.Buffer
+	buf.WriteString("; written by " + appName + " " + time.Now().UTC().Format(time.RFC3339) + "\n")
+	buf.WriteString("$ORIGIN " + origin + "\n")
+	for _, rr := range records {
+		buf.WriteString(rr.String() + "\n")
+	}
+	return writeFileAtomic(z.File, buf.Bytes(), 0o644)
+}
+
+// writeFileAtomic replaces path with data, it's written to a temp file in the same directory and
+// renamed over the original so a crash or a reader never sees half a file. An existing file keeps
+// its mode and its owner when we're allowed to, named or the service user usually needs to be able
+// to read it, a new file gets perm
+func writeFileAtomic(path string, data []byte, perm os.FileMode) error {
+	var owner *syscall.Stat_t
+	info, err := os.Stat(path)
+	if err == nil {
+		perm = info.Mode().Perm()
+		owner, _ = info.Sys().(*syscall.Stat_t)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	err = os.Chmod(tmp.Name(), perm)
+	if err != nil {
+		return err
+	}
+	if owner != nil {
+		os.Chown(tmp.Name(), int(owner.Uid), int(owner.Gid))
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// reload runs the configured reload command, the file has already been written when it fails so
+// the error says so
+func (z *ZoneFile) reload(ctx context.Context, name string) error {
+	if len(z.Reload) == 0 {
+		return nil
+	}
+	ctx, cancel := context.WithTimeout(ctx, z.timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, z.Reload[0], z.Reload[1:]...)
+	var output bytes.Buffer
+	cmd.Stdout = &limitedWriter{buf: &output, limit: execMaxStderr}
+	cmd.Stderr = cmd.Stdout
+	cmd.WaitDelay = time.Second
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return errors.New("zone file " + name + " written but reload timed out after " + z.timeout.String())
+	}
+	if err != nil {
+		message := strings.TrimSpace(output.String())
+		if message == "" {
+			message = err.Error()
+		}
+		return errors.New("zone file " + name + " written but reload failed: " + message)
+	}
+	return nil
+}
@@ -0,0 +1,359 @@
+package main
+
+import (
+	"errors"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testZone = `$ORIGIN example.com.
+$TTL 3600
+@	IN SOA ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300
+@	IN NS ns1.example.com.
+ns1	IN A 192.0.2.53
+home	300 IN A 192.0.2.1
+home	300 IN TXT "keep me"
+home	300 IN A 192.0.2.2
+txtonly	IN TXT "only text"
+alias	IN CNAME home.example.com.
+www	IN A 192.0.2.80
+`
+
+// parseZone returns the records of a zone file's text
+func parseZone(t *testing.T, text string) []dns.RR {
+	t.Helper()
+	var records []dns.RR
+	parser := dns.NewZoneParser(strings.NewReader(text), "", "")
+	for rr, ok := parser.Next(); ok; rr, ok = parser.Next() {
+		records = append(records, rr)
+	}
+	if err := parser.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return records
+}
+
+// zoneLines returns records in presentation format with single spaces between the fields
+func zoneLines(records []dns.RR) []string {
+	var lines []string
+	for _, rr := range records {
+		lines = append(lines, strings.Join(strings.Fields(rr.String()), " "))
+	}
+	return lines
+}
+
+func TestReplaceRRSet(t *testing.T) {
+	tests := []struct {
+		name      string
+		owner     string
+		fieldType string
+		ips       []string
+		ttl       int
+		want      []string
+		changed   bool
+		wantErr   bool
+	}{
+		{"A set replaced where it was and TXT on the same owner kept", "home.example.com.", "A", []string{"192.0.2.3"}, 300, []string{
+			"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300",
+			"example.com. 3600 IN NS ns1.example.com.",
+			"ns1.example.com. 3600 IN A 192.0.2.53",
+			"home.example.com. 300 IN A 192.0.2.3",
+			`home.example.com. 300 IN TXT "keep me"`,
+			"txtonly.example.com. 3600 IN TXT \"only text\"",
+			"alias.example.com. 3600 IN CNAME home.example.com.",
+			"www.example.com. 3600 IN A 192.0.2.80",
+		}, true, false},
+		{"new type goes after the owner's other records", "home.example.com.", "AAAA", []string{"2001:db8::1", "2001:db8::2"}, 300, []string{
+			"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300",
+			"example.com. 3600 IN NS ns1.example.com.",
+			"ns1.example.com. 3600 IN A 192.0.2.53",
+			"home.example.com. 300 IN A 192.0.2.1",
+			`home.example.com. 300 IN TXT "keep me"`,
+			"home.example.com. 300 IN A 192.0.2.2",
+			"home.example.com. 300 IN AAAA 2001:db8::1",
+			"home.example.com. 300 IN AAAA 2001:db8::2",
+			"txtonly.example.com. 3600 IN TXT \"only text\"",
+			"alias.example.com. 3600 IN CNAME home.example.com.",
+			"www.example.com. 3600 IN A 192.0.2.80",
+		}, true, false},
+		{"owner with only other types gets the set after them", "txtonly.example.com.", "A", []string{"192.0.2.9"}, 60, []string{
+			"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300",
+			"example.com. 3600 IN NS ns1.example.com.",
+			"ns1.example.com. 3600 IN A 192.0.2.53",
+			"home.example.com. 300 IN A 192.0.2.1",
+			`home.example.com. 300 IN TXT "keep me"`,
+			"home.example.com. 300 IN A 192.0.2.2",
+			"txtonly.example.com. 3600 IN TXT \"only text\"",
+			"txtonly.example.com. 60 IN A 192.0.2.9",
+			"alias.example.com. 3600 IN CNAME home.example.com.",
+			"www.example.com. 3600 IN A 192.0.2.80",
+		}, true, false},
+		{"owner with no records yet is added at the end", "new.example.com.", "A", []string{"192.0.2.7"}, 300, []string{
+			"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300",
+			"example.com. 3600 IN NS ns1.example.com.",
+			"ns1.example.com. 3600 IN A 192.0.2.53",
+			"home.example.com. 300 IN A 192.0.2.1",
+			`home.example.com. 300 IN TXT "keep me"`,
+			"home.example.com. 300 IN A 192.0.2.2",
+			"txtonly.example.com. 3600 IN TXT \"only text\"",
+			"alias.example.com. 3600 IN CNAME home.example.com.",
+			"www.example.com. 3600 IN A 192.0.2.80",
+			"new.example.com. 300 IN A 192.0.2.7",
+		}, true, false},
+		{"CNAME owner is refused", "alias.example.com.", "A", []string{"192.0.2.1"}, 300, nil, false, true},
+		{"identical set in another order is no change", "home.example.com.", "A", []string{"192.0.2.2", "192.0.2.1"}, 300, nil, false, false},
+		{"same addresses with a new ttl is a change", "home.example.com.", "A", []string{"192.0.2.1", "192.0.2.2"}, 60, []string{
+			"example.com. 3600 IN SOA ns1.example.com. hostmaster.example.com. 2024010101 7200 3600 1209600 300",
+			"example.com. 3600 IN NS ns1.example.com.",
+			"ns1.example.com. 3600 IN A 192.0.2.53",
+			"home.example.com. 60 IN A 192.0.2.1",
+			"home.example.com. 60 IN A 192.0.2.2",
+			`home.example.com. 300 IN TXT "keep me"`,
+			"txtonly.example.com. 3600 IN TXT \"only text\"",
+			"alias.example.com. 3600 IN CNAME home.example.com.",
+			"www.example.com. 3600 IN A 192.0.2.80",
+		}, true, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			records := parseZone(t, testZone)
+			original := zoneLines(records)
+			got, changed, err := replaceRRSet(records, test.owner, test.fieldType, test.ips, test.ttl)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, want error %v", err, test.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if changed != test.changed {
+				t.Errorf("changed = %v, want %v", changed, test.changed)
+			}
+			want := test.want
+			if !test.changed {
+				want = original
+			}
+			if lines := zoneLines(got); !slices.Equal(lines, want) {
+				t.Errorf("records =\n%s\nwant\n%s", strings.Join(lines, "\n"), strings.Join(want, "\n"))
+			}
+		})
+	}
+}
+
+func TestBumpSerial(t *testing.T) {
+	now := time.Date(2024, 6, 15, 23, 30, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		serial uint32
+		want   uint32
+	}{
+		{"date serial behind today moves to today", 2024010103, 2024061500},
+		{"date serial from today is incremented", 2024061507, 2024061508},
+		{"date serial ahead of today is incremented", 2025010100, 2025010101},
+		{"plain counter is incremented", 42, 43},
+		{"unix time serial is incremented", 1718000000, 1718000001},
+		{"wraps around under serial arithmetic", 4294967295, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			records := parseZone(t, testZone)
+			soa := records[0].(*dns.SOA)
+			soa.Serial = test.serial
+			bumpSerial(records, now)
+			if soa.Serial != test.want {
+				t.Errorf("serial = %d, want %d", soa.Serial, test.want)
+			}
+		})
+	}
+}
+
+func TestZoneFileWrite(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "example.com.zone")
+	err := os.WriteFile(path, []byte(testZone), 0o640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	owned := os.Geteuid() == 0
+	if owned {
+		err = os.Chown(path, 0, 4321)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	z := &ZoneFile{File: path}
+	records, origin, err := z.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if origin != "example.com." {
+		t.Errorf("origin = %q, want example.com.", origin)
+	}
+	records, _, err = replaceRRSet(records, "home.example.com.", "A", []string{"192.0.2.3"}, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = z.write(origin, records)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Mode().Perm() != 0o640 {
+		t.Errorf("mode = %v, want 0640", info.Mode().Perm())
+	}
+	if stat := info.Sys().(*syscall.Stat_t); owned && (stat.Uid != 0 || stat.Gid != 4321) {
+		t.Errorf("owner = %d:%d, want 0:4321", stat.Uid, stat.Gid)
+	}
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 1 {
+		t.Errorf("temp file left behind, directory has %d entries", len(entries))
+	}
+
+	// what was written reads back as the same records
+	reread, _, err := z.read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(zoneLines(reread), zoneLines(records)) {
+		t.Errorf("written zone reads back as\n%s", strings.Join(zoneLines(reread), "\n"))
+	}
+}
+
+func TestZoneFileUpdate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "example.com.zone")
+	err := os.WriteFile(path, []byte(testZone), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := config
+	defer func() { config = saved }()
+	config = &Config{Zonefiles: map[string]*ZoneFile{"lab": {File: path}}}
+	settings := map[string]string{"name": "lab"}
+
+	update := &dnsUpdate{hostname: "home.example.com", ips: []string{"192.0.2.3", "2001:db8::1"}, ttl: 300}
+	err = zoneFileUpdate(t.Context(), settings, update)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	written, _ := os.ReadFile(path)
+	records, _, err := config.Zonefiles["lab"].read()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if serial := records[0].(*dns.SOA).Serial; serial <= 2024010101 {
+		t.Errorf("serial = %d, want it bumped", serial)
+	}
+
+	// the same update again changes nothing and leaves the file alone
+	err = zoneFileUpdate(t.Context(), settings, update)
+	if !errors.Is(err, errNoChange) {
+		t.Errorf("err = %v, want nochg", err)
+	}
+	again, _ := os.ReadFile(path)
+	if string(again) != string(written) {
+		t.Error("file rewritten for an update that changed nothing")
+	}
+
+	// a hostname outside the zone and a subzone restriction are nohost
+	for _, test := range []struct {
+		settings map[string]string
+		hostname string
+	}{
+		{settings, "home.example.org"},
+		{map[string]string{"name": "lab", "zone": "dyn.example.com"}, "home.example.com"},
+	} {
+		err = zoneFileUpdate(t.Context(), test.settings, &dnsUpdate{hostname: test.hostname, ips: []string{"192.0.2.1"}, ttl: 300})
+		if classifyError(err) != errorNotFound {
+			t.Errorf("%s: err = %v, want nohost", test.hostname, err)
+		}
+	}
+}
+
+func TestZoneFileUpdateInjection(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "example.com.zone")
+	err := os.WriteFile(path, []byte(testZone), 0o644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := config
+	defer func() { config = saved }()
+	config = &Config{Zonefiles: map[string]*ZoneFile{"lab": {File: path}}}
+	settings := map[string]string{"name": "lab", "zone": "sub.example.com"}
+	hostname := "x.example.com. IN NS ns.attacker.net.\nfoo.sub.example.com"
+
+	// the form check turns it away before any provider sees it
+	r := httptest.NewRequest("GET", "/zonefile/lab/?"+url.Values{"ip": {"192.0.2.1"}, "hostname": {hostname}}.Encode(), nil)
+	_, _, err = checkFormsMulti(r)
+	if dyndnsCode(err) != dyndnsNotFQDN {
+		t.Errorf("checkFormsMulti err = %v, want notfqdn", err)
+	}
+
+	// and the provider refuses it too, leaving the file alone
+	err = zoneFileUpdate(t.Context(), settings, &dnsUpdate{hostname: hostname, ips: []string{"192.0.2.1"}, ttl: 300})
+	if dyndnsCode(err) != dyndnsNotFQDN {
+		t.Errorf("zoneFileUpdate err = %v, want notfqdn", err)
+	}
+	if written, _ := os.ReadFile(path); string(written) != testZone {
+		t.Error("zone file changed")
+	}
+
+	// whatever the owner holds, replaceRRSet only ever makes the requested type
+	records, _, err := replaceRRSet(parseZone(t, testZone), dns.CanonicalName(hostname), "A", []string{"192.0.2.1"}, 300)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ns int
+	for _, rr := range records {
+		if rr.Header().Rrtype == dns.TypeNS {
+			ns++
+		}
+	}
+	if ns != 1 {
+		t.Errorf("%d NS records after replacing an A set, want 1", ns)
+	}
+}
+
+func TestWriteFileAtomic(t *testing.T) {
+	dir := t.TempDir()
+	existing := filepath.Join(dir, "existing")
+	err := os.WriteFile(existing, []byte("old"), 0o640)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name     string
+		path     string
+		wantMode os.FileMode
+	}{
+		{"new file gets perm", filepath.Join(dir, "new"), 0o600},
+		{"existing file keeps its mode", existing, 0o640},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := writeFileAtomic(test.path, []byte("new"), 0o600)
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, _ := os.ReadFile(test.path)
+			info, _ := os.Stat(test.path)
+			if string(data) != "new" || info.Mode().Perm() != test.wantMode {
+				t.Errorf("file = %q %v, want \"new\" %v", data, info.Mode().Perm(), test.wantMode)
+			}
+		})
+	}
+	if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+		t.Errorf("temp file left behind, directory has %d entries", len(entries))
+	}
+}